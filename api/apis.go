@@ -3,3 +3,10 @@ package api
 type ITokenReader interface {
 	ReadTokens() ([]string, error)
 }
+
+// ITokenStream reads response tokens one at a time. Last is true if the token
+// completes the response. Responses without tokens are returned as an empty last token.
+type ITokenStream interface {
+	ITokenReader
+	ReadToken() (token string, last bool, err error)
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	. "github.com/vburenin/firempq_connector/fmpq_err"
+	. "github.com/vburenin/firempq_connector/pqclient"
+)
+
+const maxBodySize = 64 * 1024 * 1024
+
+type gateway struct {
+	fmc     *FireMpqClient
+	pool    *queuePool
+	maxWait int64
+}
+
+func (gw *gateway) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /queues/{queue}", gw.createQueue)
+	mux.HandleFunc("PATCH /queues/{queue}", gw.setParams)
+	mux.HandleFunc("POST /queues/{queue}/messages", gw.push)
+	mux.HandleFunc("POST /queues/{queue}/pop", gw.pop)
+	mux.HandleFunc("POST /queues/{queue}/poplock", gw.popLock)
+	mux.HandleFunc("DELETE /queues/{queue}/receipts/{receipt}", gw.deleteByReceipt)
+	mux.HandleFunc("POST /queues/{queue}/receipts/{receipt}/unlock", gw.unlockByReceipt)
+	mux.Handle("GET /healthz", gw.fmc.HealthHandler(5*time.Second))
+	return mux
+}
+
+// queueConfig is a JSON representation of PqParams.
+type queueConfig struct {
+	MsgTtl      *int64 `json:"msg_ttl"`
+	MaxSize     *int64 `json:"max_size"`
+	Delay       *int64 `json:"delay"`
+	PopLimit    *int64 `json:"pop_limit"`
+	LockTimeout *int64 `json:"lock_timeout"`
+}
+
+func (c *queueConfig) params() *PqParams {
+	p := NewPQueueOptions()
+	if c.MsgTtl != nil {
+		p.SetMsgTtl(*c.MsgTtl)
+	}
+	if c.MaxSize != nil {
+		p.SetMaxSize(*c.MaxSize)
+	}
+	if c.Delay != nil {
+		p.SetDelay(*c.Delay)
+	}
+	if c.PopLimit != nil {
+		p.SetPopLimit(*c.PopLimit)
+	}
+	if c.LockTimeout != nil {
+		p.SetLockTimeout(*c.LockTimeout)
+	}
+	return p
+}
+
+func (c *queueConfig) validate() error {
+	for _, v := range []*int64{c.MsgTtl, c.MaxSize, c.Delay, c.PopLimit, c.LockTimeout} {
+		if v != nil && *v < 0 {
+			return errors.New("Config values must be positive")
+		}
+	}
+	return nil
+}
+
+// pushMessage is a JSON representation of a pushed message. Binary payloads
+// can be sent base64 encoded in payload_base64.
+type pushMessage struct {
+	Id            string            `json:"id"`
+	Payload       string            `json:"payload"`
+	PayloadBase64 string            `json:"payload_base64"`
+	Priority      int64             `json:"priority"`
+	Delay         *int64            `json:"delay"`
+	Ttl           *int64            `json:"ttl"`
+	Headers       map[string]string `json:"headers"`
+}
+
+func (m *pushMessage) message() (*Message, error) {
+	payload := m.Payload
+	if m.PayloadBase64 != "" {
+		data, err := base64.StdEncoding.DecodeString(m.PayloadBase64)
+		if err != nil {
+			return nil, err
+		}
+		payload = string(data)
+	}
+	if m.Priority != 0 {
+		// Client doesn't send priorities to the service, so they can't be honored.
+		return nil, errors.New("Message priority is not supported")
+	}
+	msg := NewMessage(payload).SetId(m.Id).SetHeaders(m.Headers)
+	if m.Delay != nil {
+		if *m.Delay < 0 {
+			return nil, errors.New("Delay must be positive")
+		}
+		msg.SetDelay(uint64(*m.Delay))
+	}
+	if m.Ttl != nil {
+		if *m.Ttl < 0 {
+			return nil, errors.New("TTL must be positive")
+		}
+		msg.SetTtl(uint64(*m.Ttl))
+	}
+	return msg, nil
+}
+
+// poppedMessage is a JSON representation of a popped message. Payloads which
+// are not valid UTF-8 are returned base64 encoded in payload_base64.
+type poppedMessage struct {
+	Id            string            `json:"id"`
+	Payload       *string           `json:"payload,omitempty"`
+	PayloadBase64 *string           `json:"payload_base64,omitempty"`
+	Receipt       string            `json:"receipt,omitempty"`
+	ExpireTs      int64             `json:"expire_ts"`
+	UnlockTs      int64             `json:"unlock_ts,omitempty"`
+	PopCount      int64             `json:"pop_count"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Error         string            `json:"error,omitempty"`
+}
+
+func newPoppedMessage(m *QueueMessage) *poppedMessage {
+	pm := &poppedMessage{
+		Id:       m.Id,
+		Receipt:  m.Receipt,
+		ExpireTs: m.ExpireTs,
+		UnlockTs: m.UnlockTs,
+		PopCount: m.PopCount,
+		Headers:  m.Headers,
+	}
+	payload := m.Payload
+	if utf8.ValidString(payload) {
+		pm.Payload = &payload
+	} else {
+		enc := base64.StdEncoding.EncodeToString([]byte(payload))
+		pm.PayloadBase64 = &enc
+	}
+	if m.Error != nil {
+		pm.Error = m.Error.Error()
+	}
+	return pm
+}
+
+type batchItem struct {
+	Id    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+	Code  int64  `json:"code,omitempty"`
+}
+
+func (gw *gateway) createQueue(w http.ResponseWriter, r *http.Request) {
+	var cfg queueConfig
+	if !readJson(w, r, &cfg, true) {
+		return
+	}
+	if err := cfg.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	pq, err := gw.fmc.CreatePQueue(r.PathValue("queue"), cfg.params())
+	if err != nil {
+		writeFmpqError(w, err)
+		return
+	}
+	gw.pool.put(pq, nil)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (gw *gateway) setParams(w http.ResponseWriter, r *http.Request) {
+	var cfg queueConfig
+	if !readJson(w, r, &cfg, false) {
+		return
+	}
+	if err := cfg.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	gw.withQueue(w, r, func(pq *PriorityQueue) error {
+		return pq.SetParams(cfg.params())
+	}, nil)
+}
+
+func (gw *gateway) push(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		gw.pushBatch(w, r, body)
+		return
+	}
+
+	var pm pushMessage
+	if err := json.Unmarshal(body, &pm); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	msg, err := pm.message()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	msg.SetContext(r.Context())
+	gw.withQueue(w, r, func(pq *PriorityQueue) error {
+		return pq.Push(msg)
+	}, nil)
+}
+
+func (gw *gateway) pushBatch(w http.ResponseWriter, r *http.Request, body []byte) {
+	var pms []pushMessage
+	if err := json.Unmarshal(body, &pms); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	msgs := make([]*Message, len(pms))
+	for i := range pms {
+		msg, err := pms[i].message()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		msgs[i] = msg.SetContext(r.Context())
+	}
+	var items []PushBatchItem
+	gw.withQueue(w, r, func(pq *PriorityQueue) (err error) {
+		items, err = pq.PushBatch(msgs...)
+		return err
+	}, func() any {
+		resp := make([]batchItem, len(items))
+		for i, item := range items {
+			resp[i].Id = item.MsgID
+			if item.Error != nil {
+				resp[i].Error = item.Error.Error()
+				if e, ok := item.Error.(*FireMpqError); ok {
+					resp[i].Code = e.Code
+				}
+			}
+		}
+		return resp
+	})
+}
+
+func (gw *gateway) pop(w http.ResponseWriter, r *http.Request) {
+	limit, wait, _, ok := gw.popParams(w, r)
+	if !ok {
+		return
+	}
+	opts := NewPopOptions().SetLimit(limit).SetWaitTimeout(wait).SetContext(r.Context())
+	var msgs []*QueueMessage
+	gw.withQueue(w, r, func(pq *PriorityQueue) (err error) {
+		msgs, err = pq.Pop(opts)
+		return err
+	}, func() any { return poppedMessages(msgs) })
+}
+
+func (gw *gateway) popLock(w http.ResponseWriter, r *http.Request) {
+	limit, wait, lockTimeout, ok := gw.popParams(w, r)
+	if !ok {
+		return
+	}
+	opts := NewPopLockOptions().SetLimit(limit).SetWaitTimeout(wait).SetLockTimeout(lockTimeout).
+		SetContext(r.Context())
+	var msgs []*QueueMessage
+	gw.withQueue(w, r, func(pq *PriorityQueue) (err error) {
+		msgs, err = pq.PopLock(opts)
+		return err
+	}, func() any { return poppedMessages(msgs) })
+}
+
+func (gw *gateway) deleteByReceipt(w http.ResponseWriter, r *http.Request) {
+	gw.withQueue(w, r, func(pq *PriorityQueue) error {
+		return pq.DeleteByReceipt(r.PathValue("receipt"))
+	}, nil)
+}
+
+func (gw *gateway) unlockByReceipt(w http.ResponseWriter, r *http.Request) {
+	gw.withQueue(w, r, func(pq *PriorityQueue) error {
+		return pq.UnlockByReceipt(r.PathValue("receipt"))
+	}, nil)
+}
+
+// withQueue runs f with a pooled queue connection writing either an error or a result
+// returned by result function. Nil result function means 204 No Content response.
+func (gw *gateway) withQueue(w http.ResponseWriter, r *http.Request, f func(*PriorityQueue) error, result func() any) {
+	pq, err := gw.pool.get(r.PathValue("queue"))
+	if err != nil {
+		writeFmpqError(w, err)
+		return
+	}
+	err = f(pq)
+	gw.pool.put(pq, err)
+	if err != nil {
+		writeFmpqError(w, err)
+		return
+	}
+	if result == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJson(w, http.StatusOK, result())
+}
+
+// popParams parses limit, wait and lock_timeout query parameters. Wait is capped by max wait.
+func (gw *gateway) popParams(w http.ResponseWriter, r *http.Request) (int64, int64, int64, bool) {
+	q := r.URL.Query()
+	vals := [3]int64{0, 0, -1}
+	for i, name := range []string{"limit", "wait", "lock_timeout"} {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("Invalid "+name+" value: "+v))
+			return 0, 0, 0, false
+		}
+		vals[i] = n
+	}
+	if vals[1] > gw.maxWait {
+		vals[1] = gw.maxWait
+	}
+	return vals[0], vals[1], vals[2], true
+}
+
+func poppedMessages(msgs []*QueueMessage) []*poppedMessage {
+	resp := make([]*poppedMessage, len(msgs))
+	for i, m := range msgs {
+		resp[i] = newPoppedMessage(m)
+	}
+	return resp
+}
+
+// readJson decodes request body. Empty body is allowed only if optional is true.
+func readJson(w http.ResponseWriter, r *http.Request, v any, optional bool) bool {
+	br := bufio.NewReader(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if _, err := br.Peek(1); err == io.EOF && optional {
+		return true
+	}
+	if err := json.NewDecoder(br).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+// httpStatus maps errors to HTTP statuses. FireMPQ error codes are HTTP alike,
+// so they are used as is if they are in a valid range.
+func httpStatus(err error) int {
+	var fmpqErr *FireMpqError
+	var circuitErr *CircuitOpenError
+	switch {
+	case errors.As(err, &fmpqErr):
+		if fmpqErr.Code >= 400 && fmpqErr.Code < 600 {
+			return int(fmpqErr.Code)
+		}
+	case errors.As(err, &circuitErr):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func writeFmpqError(w http.ResponseWriter, err error) {
+	writeError(w, httpStatus(err), err)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	resp := struct {
+		Error string `json:"error"`
+		Code  int64  `json:"code,omitempty"`
+	}{Error: err.Error()}
+	if e, ok := err.(*FireMpqError); ok {
+		resp.Error = e.Desc
+		resp.Code = e.Code
+	}
+	writeJson(w, status, resp)
+}
+
+func writeJson(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
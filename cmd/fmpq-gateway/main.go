@@ -0,0 +1,54 @@
+// Command fmpq-gateway exposes FireMPQ priority queues over HTTP/JSON for clients
+// which don't have a native FireMPQ client.
+//
+// Endpoints:
+//
+//	PUT    /queues/{queue}                             create a queue, body: queue config
+//	PATCH  /queues/{queue}                             update queue config, body: queue config
+//	POST   /queues/{queue}/messages                    push a message object or a batch array
+//	POST   /queues/{queue}/pop?limit=&wait=            pop messages
+//	POST   /queues/{queue}/poplock?limit=&wait=&lock_timeout=
+//	                                                   pop and lock messages
+//	DELETE /queues/{queue}/receipts/{receipt}          delete locked message by receipt
+//	POST   /queues/{queue}/receipts/{receipt}/unlock   unlock message by receipt
+//	GET    /healthz                                    client health
+//
+// All time values are in milliseconds. Long polling is done with the wait parameter.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	. "github.com/vburenin/firempq_connector/pqclient"
+)
+
+func main() {
+	listen := flag.String("listen", ":8080", "HTTP listen address")
+	network := flag.String("network", "tcp", "FireMPQ network")
+	address := flag.String("fmpq", "127.0.0.1:9033", "FireMPQ address")
+	maxIdle := flag.Int("max-idle", 8, "Max idle connections per queue")
+	maxWait := flag.Int64("max-wait", 20000, "Max long polling wait in milliseconds")
+	flag.Parse()
+
+	fmc, err := NewFireMpqClient(*network, *address)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	gw := &gateway{
+		fmc:     fmc,
+		pool:    newQueuePool(fmc, *maxIdle),
+		maxWait: *maxWait,
+	}
+	srv := &http.Server{
+		Addr:              *listen,
+		Handler:           gw.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      time.Duration(*maxWait)*time.Millisecond + 30*time.Second,
+	}
+	log.Printf("Serving FireMPQ %s on %s", *address, *listen)
+	log.Fatal(srv.ListenAndServe())
+}
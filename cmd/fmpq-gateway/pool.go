@@ -0,0 +1,49 @@
+package main
+
+import (
+	"sync"
+
+	. "github.com/vburenin/firempq_connector/fmpq_err"
+	. "github.com/vburenin/firempq_connector/pqclient"
+)
+
+// queuePool keeps idle queue connections, since a single PriorityQueue can't be
+// used by concurrent requests.
+type queuePool struct {
+	fmc     *FireMpqClient
+	maxIdle int
+	lock    sync.Mutex
+	idle    map[string][]*PriorityQueue
+}
+
+func newQueuePool(fmc *FireMpqClient, maxIdle int) *queuePool {
+	return &queuePool{fmc: fmc, maxIdle: maxIdle, idle: make(map[string][]*PriorityQueue)}
+}
+
+func (p *queuePool) get(name string) (*PriorityQueue, error) {
+	p.lock.Lock()
+	if idle := p.idle[name]; len(idle) > 0 {
+		pq := idle[len(idle)-1]
+		p.idle[name] = idle[:len(idle)-1]
+		p.lock.Unlock()
+		return pq, nil
+	}
+	p.lock.Unlock()
+	return p.fmc.GetPQueue(name)
+}
+
+// put returns queue connection into the pool unless the last call failed with an I/O
+// error, which leaves connection in unknown state, or the connection is desynchronized.
+func (p *queuePool) put(pq *PriorityQueue, err error) {
+	if _, ok := err.(*FireMpqError); (err != nil && !ok) || pq.ConnError() != nil {
+		pq.Close()
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if idle := p.idle[pq.GetName()]; len(idle) < p.maxIdle {
+		p.idle[pq.GetName()] = append(idle, pq)
+		return
+	}
+	pq.Close()
+}
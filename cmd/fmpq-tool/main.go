@@ -0,0 +1,40 @@
+// Command fmpq-tool is a set of FireMPQ maintenance commands.
+//
+// Usage:
+//
+//	fmpq-tool migrate -src-queue name -dst-queue name [flags]
+//	fmpq-tool export -queue name [-out file] [flags]
+//	fmpq-tool import -queue name [-in file] [flags]
+//
+// Run a command with -h to see its flags.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+var commands = map[string]func(args []string) error{
+	"migrate": migrateCmd,
+	"export":  exportCmd,
+	"import":  importCmd,
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	if err := cmd(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err.Error())
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: fmpq-tool migrate|export|import [flags]")
+	os.Exit(2)
+}
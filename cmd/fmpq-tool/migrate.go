@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+
+	. "github.com/vburenin/firempq_connector/pqclient"
+)
+
+// migrateCmd moves messages between queues, possibly on different servers.
+// Interrupted migration can be restarted with the same checkpoint file.
+func migrateCmd(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	network := fs.String("network", "tcp", "FireMPQ network")
+	srcAddr := fs.String("src", "127.0.0.1:9033", "Source FireMPQ address")
+	srcQueue := fs.String("src-queue", "", "Source queue name")
+	dstAddr := fs.String("dst", "", "Destination FireMPQ address, source address if empty")
+	dstQueue := fs.String("dst-queue", "", "Destination queue name")
+	batch := fs.Int64("batch", 100, "Messages moved at once")
+	lockTimeout := fs.Int64("lock-timeout", 60000, "Source message lock timeout in milliseconds")
+	wait := fs.Int64("wait", 0, "Wait for new messages in milliseconds before stopping")
+	checkpoint := fs.String("checkpoint", "", "Checkpoint file")
+	decode := fs.Bool("decode", false, "Decode payloads and encode them with destination settings")
+	fs.Parse(args)
+
+	if *srcQueue == "" || *dstQueue == "" {
+		return errors.New("Source and destination queues are required")
+	}
+	if *dstAddr == "" {
+		*dstAddr = *srcAddr
+	}
+	if *srcAddr == *dstAddr && *srcQueue == *dstQueue {
+		return errors.New("Source and destination must be different")
+	}
+
+	srcClient, err := NewFireMpqClient(*network, *srcAddr)
+	if err != nil {
+		return err
+	}
+	dstClient := srcClient
+	if *dstAddr != *srcAddr {
+		if dstClient, err = NewFireMpqClient(*network, *dstAddr); err != nil {
+			return err
+		}
+	}
+	src, err := srcClient.GetPQueue(*srcQueue)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := dstClient.GetPQueue(*dstQueue)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	opts := NewMigrateOptions().
+		SetBatchSize(*batch).
+		SetLockTimeout(*lockTimeout).
+		SetWaitTimeout(*wait).
+		SetCheckpointFile(*checkpoint).
+		SetDecode(*decode).
+		SetProgressCallback(func(p *MigrateProgress) {
+			log.Printf("Moved: %d, expired: %d, failed: %d", p.Moved, p.Expired, p.Failed)
+		})
+	p, err := Migrate(ctx, src, dst, opts)
+	if err != nil {
+		return err
+	}
+	log.Printf("Done in %s. Moved: %d, expired: %d, failed: %d",
+		p.Updated.Sub(p.Started), p.Moved, p.Expired, p.Failed)
+	return nil
+}
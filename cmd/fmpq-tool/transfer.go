@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+
+	. "github.com/vburenin/firempq_connector/pqclient"
+)
+
+// exportCmd dumps queue messages into a JSONL file, "-" means stdout.
+func exportCmd(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	network := fs.String("network", "tcp", "FireMPQ network")
+	addr := fs.String("fmpq", "127.0.0.1:9033", "FireMPQ address")
+	queue := fs.String("queue", "", "Queue name")
+	out := fs.String("out", "-", "Output file")
+	destructive := fs.Bool("destructive", false, "Remove exported messages from the queue")
+	batch := fs.Int64("batch", 100, "Messages popped at once")
+	lockTimeout := fs.Int64("lock-timeout", 600000, "Lock timeout in milliseconds for non destructive export")
+	decode := fs.Bool("decode", false, "Export decoded payloads and headers instead of raw ones")
+	fs.Parse(args)
+
+	if *queue == "" {
+		return errors.New("Queue name is required")
+	}
+	pq, err := getQueue(*network, *addr, *queue, false)
+	if err != nil {
+		return err
+	}
+	defer pq.Close()
+
+	var w io.Writer = os.Stdout
+	var f *os.File
+	if *out != "-" {
+		if f, err = os.Create(*out); err != nil {
+			return err
+		}
+		w = f
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	opts := NewExportOptions().
+		SetDestructive(*destructive).
+		SetBatchSize(*batch).
+		SetLockTimeout(*lockTimeout).
+		SetDecode(*decode)
+	n, err := Export(ctx, pq, w, opts)
+	if f != nil {
+		// Write errors of the file may be reported only by Close.
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	log.Printf("Exported %d messages", n)
+	return err
+}
+
+// importCmd pushes messages from a JSONL file produced by export, "-" means stdin.
+func importCmd(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	network := fs.String("network", "tcp", "FireMPQ network")
+	addr := fs.String("fmpq", "127.0.0.1:9033", "FireMPQ address")
+	queue := fs.String("queue", "", "Queue name")
+	in := fs.String("in", "-", "Input file")
+	create := fs.Bool("create", false, "Create the queue")
+	batch := fs.Int64("batch", 100, "Messages pushed at once")
+	conflict := fs.String("conflict", "skip", "Id conflict handling: skip, fail or new-id")
+	fs.Parse(args)
+
+	if *queue == "" {
+		return errors.New("Queue name is required")
+	}
+	modes := map[string]ConflictMode{"skip": ConflictSkip, "fail": ConflictFail, "new-id": ConflictNewId}
+	mode, ok := modes[*conflict]
+	if !ok {
+		return errors.New("Unknown conflict mode: " + *conflict)
+	}
+
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	pq, err := getQueue(*network, *addr, *queue, *create)
+	if err != nil {
+		return err
+	}
+	defer pq.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	res, err := Import(ctx, pq, r, NewImportOptions().SetBatchSize(*batch).SetConflictMode(mode))
+	log.Printf("Imported: %d, skipped: %d, expired: %d", res.Imported, res.Skipped, res.Expired)
+	return err
+}
+
+func getQueue(network, addr, queue string, create bool) (*PriorityQueue, error) {
+	fmc, err := NewFireMpqClient(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if create {
+		return fmc.CreatePQueue(queue, NewPQueueOptions())
+	}
+	return fmc.GetPQueue(queue)
+}
@@ -5,16 +5,28 @@ import (
 )
 
 func EncodeString(v string) []byte {
-	// format: ${length}{space}{content}
-	a := make([]byte, 1, 12+len(v))
-	a[0] = '$'
-	num := strconv.AppendInt(make([]byte, 0, 10), int64(len(v)), 10)
-	a = append(a, num...)
-	a = append(a, ' ')
-	a = append(a, v...)
-	return a
+	return AppendString(make([]byte, 0, 12+len(v)), v)
 }
 
 func EncodeInt64(v int64) []byte {
-	return strconv.AppendInt(make([]byte, 0, 10), v, 10)
+	return AppendInt64(make([]byte, 0, 10), v)
+}
+
+// AppendString appends encoded string to dst.
+func AppendString(dst []byte, v string) []byte {
+	// format: ${length}{space}{content}
+	dst = AppendStringPrefix(dst, v)
+	return append(dst, v...)
+}
+
+// AppendStringPrefix appends length prefix of encoded string to dst.
+func AppendStringPrefix(dst []byte, v string) []byte {
+	dst = append(dst, '$')
+	dst = strconv.AppendInt(dst, int64(len(v)), 10)
+	return append(dst, ' ')
+}
+
+// AppendInt64 appends encoded integer to dst.
+func AppendInt64(dst []byte, v int64) []byte {
+	return strconv.AppendInt(dst, v, 10)
 }
@@ -0,0 +1,84 @@
+package envelope
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// EncodingClaimCheck is an envelope encoding name of bodies replaced by a blob reference.
+const EncodingClaimCheck = "claim-check"
+
+var ErrInvalidBlobRef = errors.New("Invalid blob reference")
+
+// BlobStore stores payloads which are too large to be pushed into the queue.
+// Only a reference returned by Put is pushed instead of the payload.
+type BlobStore interface {
+	Put(data []byte) (ref string, err error)
+	Get(ref string) ([]byte, error)
+	Delete(ref string) error
+}
+
+// FileBlobStore is a BlobStore keeping blobs as files in a local directory.
+// Producers and consumers must share the directory, e.g. through a network file system.
+type FileBlobStore struct {
+	dir string
+}
+
+// NewFileBlobStore creates blob store in dir creating the directory if needed.
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	return &FileBlobStore{dir: dir}, nil
+}
+
+func (fs *FileBlobStore) Put(data []byte) (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	ref := hex.EncodeToString(id[:])
+	tmp := filepath.Join(fs.dir, ref+".tmp")
+	if err := os.WriteFile(tmp, data, 0640); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, filepath.Join(fs.dir, ref)); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return ref, nil
+}
+
+func (fs *FileBlobStore) Get(ref string) ([]byte, error) {
+	path, err := fs.path(ref)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+func (fs *FileBlobStore) Delete(ref string) error {
+	path, err := fs.path(ref)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// path validates reference, so it can't be used to access files outside of the store.
+func (fs *FileBlobStore) path(ref string) (string, error) {
+	if len(ref) != 32 {
+		return "", ErrInvalidBlobRef
+	}
+	if _, err := hex.DecodeString(ref); err != nil {
+		return "", ErrInvalidBlobRef
+	}
+	return filepath.Join(fs.dir, ref), nil
+}
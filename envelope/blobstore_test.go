@@ -0,0 +1,46 @@
+package envelope
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestFileBlobStore(t *testing.T) {
+	store, err := NewFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := store.Put([]byte("blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := store.Get(ref)
+	if err != nil || string(data) != "blob" {
+		t.Fatalf("Got %q, %v", data, err)
+	}
+	if err := store.Delete(ref); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ref); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Got %v after delete, want not exist", err)
+	}
+	if err := store.Delete(ref); err != nil {
+		t.Fatalf("Deleting missing blob failed: %v", err)
+	}
+}
+
+func TestFileBlobStoreRejectsInvalidRefs(t *testing.T) {
+	store, err := NewFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{"", "abc", "../../../../../../../../etc/passwd", "zz" + string(make([]byte, 30))} {
+		if _, err := store.Get(ref); err != ErrInvalidBlobRef {
+			t.Errorf("Get(%q) returned %v", ref, err)
+		}
+		if err := store.Delete(ref); err != ErrInvalidBlobRef {
+			t.Errorf("Delete(%q) returned %v", ref, err)
+		}
+	}
+}
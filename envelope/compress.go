@@ -0,0 +1,135 @@
+package envelope
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Compressor compresses message bodies. Its name is stored in the envelope,
+// so the same compressor must be registered on the consumer side with RegisterCompressor.
+// Decompress must not return more than MaxDecompressedSize bytes.
+type Compressor interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// MaxDecompressedSize limits the size of decompressed payloads, so a small malicious
+// payload can't expand into gigabytes of memory. It matches the max message size
+// the client accepts from the service.
+const MaxDecompressedSize = 128 * 1024 * 1024
+
+var ErrDecompressedTooLarge = errors.New("Decompressed payload is too large")
+
+var (
+	compressorsLock sync.RWMutex
+	compressors     = map[string]Compressor{}
+)
+
+func init() {
+	RegisterCompressor(NewGzipCompressor(gzip.DefaultCompression))
+	RegisterCompressor(NewFlateCompressor(flate.DefaultCompression))
+}
+
+// RegisterCompressor makes compressor available for decompression of popped messages.
+// Snappy, zstd or any other algorithm can be plugged in this way.
+func RegisterCompressor(c Compressor) {
+	compressorsLock.Lock()
+	compressors[c.Name()] = c
+	compressorsLock.Unlock()
+}
+
+// GetCompressor returns registered compressor by its name.
+func GetCompressor(name string) (Compressor, bool) {
+	compressorsLock.RLock()
+	c, ok := compressors[name]
+	compressorsLock.RUnlock()
+	return c, ok
+}
+
+type gzipCompressor struct {
+	level int
+}
+
+// NewGzipCompressor returns gzip compressor with a given compression level.
+func NewGzipCompressor(level int) Compressor {
+	return &gzipCompressor{level: level}
+}
+
+func (c *gzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (c *gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readLimited(r)
+}
+
+type flateCompressor struct {
+	level int
+}
+
+// NewFlateCompressor returns deflate compressor with a given compression level.
+func NewFlateCompressor(level int) Compressor {
+	return &flateCompressor{level: level}
+}
+
+func (c *flateCompressor) Name() string {
+	return "deflate"
+}
+
+func (c *flateCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *flateCompressor) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return readLimited(r)
+}
+
+// readLimited reads decompressed data failing if it exceeds MaxDecompressedSize.
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxDecompressedSize {
+		return nil, ErrDecompressedTooLarge
+	}
+	return data, nil
+}
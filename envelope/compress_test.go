@@ -0,0 +1,76 @@
+package envelope
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"testing"
+)
+
+func TestCompressorsRoundTrip(t *testing.T) {
+	inputs := [][]byte{
+		{},
+		[]byte("x"),
+		bytes.Repeat([]byte("compressible payload "), 1000),
+	}
+	for _, name := range []string{"gzip", "deflate"} {
+		c, ok := GetCompressor(name)
+		if !ok {
+			t.Fatalf("Compressor %s is not registered", name)
+		}
+		for _, data := range inputs {
+			compressed, err := c.Compress(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decompressed, err := c.Decompress(compressed)
+			if err != nil || !bytes.Equal(decompressed, data) {
+				t.Errorf("%s: got %d bytes, %v, want %d bytes", name, len(decompressed), err, len(data))
+			}
+		}
+	}
+}
+
+func TestDecompressCorrupted(t *testing.T) {
+	for _, name := range []string{"gzip", "deflate"} {
+		c, _ := GetCompressor(name)
+		compressed, err := c.Compress(bytes.Repeat([]byte("a"), 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Decompress(compressed[:len(compressed)/2]); err == nil {
+			t.Errorf("%s: truncated data is decompressed", name)
+		}
+	}
+}
+
+func TestDecompressSizeLimit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Decompresses over 128MB")
+	}
+	bomb := func(w io.WriteCloser) {
+		chunk := make([]byte, 1024*1024)
+		for n := 0; n <= MaxDecompressedSize; n += len(chunk) {
+			if _, err := w.Write(chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var gz bytes.Buffer
+	bomb(gzip.NewWriter(&gz))
+	if _, err := NewGzipCompressor(gzip.DefaultCompression).Decompress(gz.Bytes()); err != ErrDecompressedTooLarge {
+		t.Errorf("gzip: got %v, want ErrDecompressedTooLarge", err)
+	}
+
+	var fl bytes.Buffer
+	w, _ := flate.NewWriter(&fl, flate.DefaultCompression)
+	bomb(w)
+	if _, err := NewFlateCompressor(flate.DefaultCompression).Decompress(fl.Bytes()); err != ErrDecompressedTooLarge {
+		t.Errorf("deflate: got %v, want ErrDecompressedTooLarge", err)
+	}
+}
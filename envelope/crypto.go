@@ -0,0 +1,139 @@
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// EncodingAesGcm is an envelope encoding name of AES-GCM encrypted bodies.
+const EncodingAesGcm = "aes-gcm"
+
+var (
+	ErrMalformedCiphertext = errors.New("Malformed encrypted payload")
+	ErrNoCurrentKey        = errors.New("No current encryption key")
+)
+
+// KeyProvider provides AES keys for payload encryption. Key ids are stored with
+// encrypted payloads, so messages encrypted with old keys can be decrypted after
+// key rotation as long as provider still knows these keys.
+type KeyProvider interface {
+	// CurrentKey returns a key used to encrypt new messages.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns a key by its id. It must return UnknownKeyError if key is not known.
+	Key(id string) ([]byte, error)
+}
+
+// UnknownKeyError is returned if message is encrypted with a key unknown to KeyProvider.
+type UnknownKeyError struct {
+	KeyId string
+}
+
+func (e *UnknownKeyError) Error() string {
+	return "Unknown encryption key: " + e.KeyId
+}
+
+// KeyRing is a simple in-memory KeyProvider.
+type KeyRing struct {
+	mu      sync.RWMutex
+	keys    map[string][]byte
+	current string
+}
+
+func NewKeyRing() *KeyRing {
+	return &KeyRing{keys: make(map[string][]byte)}
+}
+
+// AddKey adds a key to the key ring. Key length must be 16, 24 or 32 bytes.
+// The last added key becomes current.
+func (kr *KeyRing) AddKey(id string, key []byte) error {
+	if _, err := aes.NewCipher(key); err != nil {
+		return err
+	}
+	kr.mu.Lock()
+	kr.keys[id] = key
+	kr.current = id
+	kr.mu.Unlock()
+	return nil
+}
+
+// RemoveKey removes a key. Messages encrypted with it can't be decrypted anymore.
+func (kr *KeyRing) RemoveKey(id string) {
+	kr.mu.Lock()
+	delete(kr.keys, id)
+	if kr.current == id {
+		kr.current = ""
+	}
+	kr.mu.Unlock()
+}
+
+func (kr *KeyRing) CurrentKey() (string, []byte, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	if kr.current == "" {
+		return "", nil, ErrNoCurrentKey
+	}
+	return kr.current, kr.keys[kr.current], nil
+}
+
+func (kr *KeyRing) Key(id string) ([]byte, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	if key, ok := kr.keys[id]; ok {
+		return key, nil
+	}
+	return nil, &UnknownKeyError{KeyId: id}
+}
+
+// Encrypt encrypts data with the current key of the provider.
+// Format: uvarint(len) key id, nonce, ciphertext. Key id is authenticated as well.
+func Encrypt(kp KeyProvider, data []byte) ([]byte, error) {
+	id, key, err := kp.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, binary.MaxVarintLen64+len(id)+aead.NonceSize()+len(data)+aead.Overhead())
+	out = appendString(out, id)
+	nonceStart := len(out)
+	out = out[:nonceStart+aead.NonceSize()]
+	if _, err := rand.Read(out[nonceStart:]); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, out[nonceStart:], data, []byte(id)), nil
+}
+
+// Decrypt decrypts data encrypted by Encrypt looking up a key by its id.
+func Decrypt(kp KeyProvider, data []byte) ([]byte, error) {
+	id, rest, ok := readString(string(data))
+	if !ok {
+		return nil, ErrMalformedCiphertext
+	}
+	key, err := kp.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, ErrMalformedCiphertext
+	}
+	nonce, ciphertext := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+	return aead.Open(nil, []byte(nonce), []byte(ciphertext), []byte(id))
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,144 @@
+package envelope
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func testKeyRing(t *testing.T, ids ...string) *KeyRing {
+	kr := NewKeyRing()
+	for i, id := range ids {
+		if err := kr.AddKey(id, bytes.Repeat([]byte{byte(i + 1)}, 32)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return kr
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	kr := testKeyRing(t, "k1")
+	for _, data := range [][]byte{{}, []byte("secret payload")} {
+		encrypted, err := Encrypt(kr, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) > 0 && bytes.Contains(encrypted, data) {
+			t.Fatal("Payload is not encrypted")
+		}
+		decrypted, err := Decrypt(kr, encrypted)
+		if err != nil || !bytes.Equal(decrypted, data) {
+			t.Fatalf("Got %q, %v, want %q", decrypted, err, data)
+		}
+	}
+}
+
+func TestEncryptUsesRandomNonce(t *testing.T) {
+	kr := testKeyRing(t, "k1")
+	a, _ := Encrypt(kr, []byte("payload"))
+	b, _ := Encrypt(kr, []byte("payload"))
+	if bytes.Equal(a, b) {
+		t.Fatal("Same payload is encrypted into the same ciphertext")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	kr := testKeyRing(t, "old")
+	old, err := Encrypt(kr, []byte("old payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kr.AddKey("new", bytes.Repeat([]byte{9}, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if id, _, _ := kr.CurrentKey(); id != "new" {
+		t.Fatalf("Got current key %q, want new", id)
+	}
+	encrypted, err := Encrypt(kr, []byte("new payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := Decrypt(kr, old); err != nil || string(data) != "old payload" {
+		t.Fatalf("Decrypting with old key returned %q, %v", data, err)
+	}
+
+	kr.RemoveKey("old")
+	var unknown *UnknownKeyError
+	if _, err := Decrypt(kr, old); !errors.As(err, &unknown) || unknown.KeyId != "old" {
+		t.Fatalf("Got %v, want unknown key error", err)
+	}
+	if data, err := Decrypt(kr, encrypted); err != nil || string(data) != "new payload" {
+		t.Fatalf("Decrypting with new key returned %q, %v", data, err)
+	}
+
+	kr.RemoveKey("new")
+	if _, err := Encrypt(kr, []byte("payload")); err != ErrNoCurrentKey {
+		t.Fatalf("Got %v, want ErrNoCurrentKey", err)
+	}
+}
+
+func TestAddKeyRejectsInvalidKeys(t *testing.T) {
+	if err := NewKeyRing().AddKey("k", []byte("short")); err == nil {
+		t.Fatal("Invalid key is added")
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	kr := testKeyRing(t, "k1", "k2")
+	encrypted, err := Encrypt(kr, []byte("secret payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Key id "k2" takes 3 bytes followed by 12 bytes of nonce.
+	const nonceStart, ciphertextStart = 3, 15
+	tamper := func(i int) []byte {
+		b := bytes.Clone(encrypted)
+		b[i] ^= 1
+		return b
+	}
+	renamed := bytes.Clone(encrypted)
+	renamed[2] = '1'
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"nonce", tamper(nonceStart)},
+		{"ciphertext", tamper(ciphertextStart)},
+		{"tag", tamper(len(encrypted) - 1)},
+		{"key id", renamed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if data, err := Decrypt(kr, tt.data); err == nil {
+				t.Fatalf("Tampered payload is decrypted into %q", data)
+			}
+		})
+	}
+}
+
+func TestDecryptTruncated(t *testing.T) {
+	kr := testKeyRing(t, "k1")
+	encrypted, err := Encrypt(kr, []byte("secret payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, ErrMalformedCiphertext},
+		{"key id", encrypted[:2], ErrMalformedCiphertext},
+		{"nonce", encrypted[:10], ErrMalformedCiphertext},
+		{"ciphertext", encrypted[:len(encrypted)-1], nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decrypt(kr, tt.data)
+			if err == nil || tt.want != nil && err != tt.want {
+				t.Fatalf("Got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
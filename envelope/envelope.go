@@ -0,0 +1,135 @@
+package envelope
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// Envelope wraps message payload with a set of headers. It is stored inside of the
+// message payload, so it doesn't need any support from the service.
+//
+// Binary format:
+//
+//	magic(4) version(1) uvarint(headers count) {uvarint(len) key uvarint(len) value}... body
+//
+// Header names starting with ':' are reserved for the envelope itself.
+type Envelope struct {
+	Headers map[string]string
+	// Encodings lists transformations applied to the body in the order they were applied.
+	Encodings []string
+	Body      string
+}
+
+// headerEncodings is a reserved header storing envelope encodings.
+const headerEncodings = ":enc"
+
+const (
+	magic   = "\x00FQE"
+	version = 1
+)
+
+var ErrMalformedEnvelope = errors.New("Malformed message envelope")
+
+// IsEnvelope returns true if payload starts with an envelope header.
+func IsEnvelope(payload string) bool {
+	return strings.HasPrefix(payload, magic)
+}
+
+// Marshal encodes envelope into a payload string.
+func Marshal(env *Envelope) string {
+	encodings := strings.Join(env.Encodings, ",")
+	count := len(env.Headers)
+	if _, ok := env.Headers[headerEncodings]; ok {
+		count--
+	}
+	size := len(magic) + 1 + binary.MaxVarintLen64 + len(env.Body)
+	for k, v := range env.Headers {
+		size += len(k) + len(v) + 2*binary.MaxVarintLen64
+	}
+	if encodings != "" {
+		count++
+		size += len(headerEncodings) + len(encodings) + 2*binary.MaxVarintLen64
+	}
+	b := make([]byte, 0, size)
+	b = append(b, magic...)
+	b = append(b, version)
+	b = binary.AppendUvarint(b, uint64(count))
+	for k, v := range env.Headers {
+		if k == headerEncodings {
+			continue
+		}
+		b = appendString(b, k)
+		b = appendString(b, v)
+	}
+	if encodings != "" {
+		b = appendString(b, headerEncodings)
+		b = appendString(b, encodings)
+	}
+	b = append(b, env.Body...)
+	return string(b)
+}
+
+// Unmarshal decodes payload into an envelope. Payloads without envelope header
+// are returned as a body of an envelope without headers.
+func Unmarshal(payload string) (*Envelope, error) {
+	if !IsEnvelope(payload) {
+		return &Envelope{Body: payload}, nil
+	}
+	data := payload[len(magic):]
+	if len(data) == 0 || data[0] != version {
+		return nil, ErrMalformedEnvelope
+	}
+	data = data[1:]
+	count, n := uvarint(data)
+	if n <= 0 || count > uint64(len(data)) {
+		return nil, ErrMalformedEnvelope
+	}
+	data = data[n:]
+	env := &Envelope{Headers: make(map[string]string, count)}
+	for i := uint64(0); i < count; i++ {
+		var k, v string
+		var ok bool
+		if k, data, ok = readString(data); !ok {
+			return nil, ErrMalformedEnvelope
+		}
+		if v, data, ok = readString(data); !ok {
+			return nil, ErrMalformedEnvelope
+		}
+		if k == headerEncodings {
+			env.Encodings = strings.Split(v, ",")
+		} else {
+			env.Headers[k] = v
+		}
+	}
+	env.Body = data
+	return env, nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func readString(data string) (string, string, bool) {
+	l, n := uvarint(data)
+	if n <= 0 || l > uint64(len(data)-n) {
+		return "", data, false
+	}
+	data = data[n:]
+	return data[:l], data[l:], true
+}
+
+func uvarint(data string) (uint64, int) {
+	var x uint64
+	var s uint
+	for i := 0; i < len(data) && i < binary.MaxVarintLen64; i++ {
+		b := data[i]
+		if b < 0x80 {
+			return x | uint64(b)<<s, i + 1
+		}
+		x |= uint64(b&0x7f) << s
+		s += 7
+	}
+	return 0, 0
+}
@@ -0,0 +1,87 @@
+package envelope
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		env  Envelope
+	}{
+		{"empty", Envelope{}},
+		{"body only", Envelope{Body: "payload"}},
+		{"headers", Envelope{Headers: map[string]string{"a": "1", "content-type": "text/plain", "": ""}, Body: "payload"}},
+		{"encodings", Envelope{Encodings: []string{"gzip", "aes-gcm"}, Body: "\x00\x01\x02"}},
+		{"headers and encodings", Envelope{Headers: map[string]string{"k": "v"}, Encodings: []string{"deflate"}, Body: magic}},
+		{"long header", Envelope{Headers: map[string]string{"k": string(make([]byte, 300))}, Body: "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := Marshal(&tt.env)
+			if !IsEnvelope(payload) {
+				t.Fatalf("Marshaled payload %q is not an envelope", payload)
+			}
+			env, err := Unmarshal(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if env.Body != tt.env.Body {
+				t.Errorf("Got body %q, want %q", env.Body, tt.env.Body)
+			}
+			if len(env.Headers) != len(tt.env.Headers) || len(tt.env.Headers) > 0 && !reflect.DeepEqual(env.Headers, tt.env.Headers) {
+				t.Errorf("Got headers %v, want %v", env.Headers, tt.env.Headers)
+			}
+			if !reflect.DeepEqual(env.Encodings, tt.env.Encodings) {
+				t.Errorf("Got encodings %v, want %v", env.Encodings, tt.env.Encodings)
+			}
+		})
+	}
+}
+
+func TestMarshalIgnoresReservedHeaders(t *testing.T) {
+	env, err := Unmarshal(Marshal(&Envelope{Headers: map[string]string{headerEncodings: "gzip"}, Body: "b"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(env.Headers) != 0 || env.Encodings != nil {
+		t.Fatalf("Reserved header is marshaled: %+v", env)
+	}
+}
+
+func TestUnmarshalMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{"no version", magic},
+		{"wrong version", magic + "\x02\x00"},
+		{"no headers count", magic + "\x01"},
+		{"headers count overflow", magic + "\x01\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff"},
+		{"headers count too big", magic + "\x01\x05\x01k\x01v"},
+		{"no header key", magic + "\x01\x01"},
+		{"truncated header key", magic + "\x01\x01\x05key"},
+		{"no header value", magic + "\x01\x01\x01k"},
+		{"truncated header value", magic + "\x01\x01\x01k\x03v"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if env, err := Unmarshal(tt.payload); err != ErrMalformedEnvelope {
+				t.Fatalf("Got %+v, %v, want ErrMalformedEnvelope", env, err)
+			}
+		})
+	}
+}
+
+func TestPlainPayloads(t *testing.T) {
+	for _, payload := range []string{"", "payload", "\x00", "\x00FQ", "\x00FQX\x01\x00", "\x00\x00\x00\x00"} {
+		if IsEnvelope(payload) {
+			t.Errorf("IsEnvelope(%q) is true", payload)
+		}
+		env, err := Unmarshal(payload)
+		if err != nil || env.Body != payload || env.Headers != nil || env.Encodings != nil {
+			t.Errorf("Unmarshal(%q) returned %+v, %v", payload, env, err)
+		}
+	}
+}
@@ -1,84 +1,16 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"log"
-	"net"
 	"os"
 	"strconv"
 	"sync"
 	"time"
 
-	. "github.com/vburenin/firempq_connector/fmpq_err"
-	. "github.com/vburenin/firempq_connector/parsers"
 	. "github.com/vburenin/firempq_connector/pqclient"
 )
 
-type FireMpqClient struct {
-	connFactory func() (net.Conn, error)
-	version     string
-}
-
-// NewFireMpqClient makes a first connection to the service to ensure service availability
-// and returns a client instance.
-func NewFireMpqClient(network, address string) (*FireMpqClient, error) {
-	factory := func() (net.Conn, error) {
-		return net.Dial(network, address)
-	}
-
-	fmc := &FireMpqClient{connFactory: factory}
-	if c, _, _, err := fmc.makeConn(); err != nil {
-		return nil, err
-	} else {
-		c.Write([]byte("QUIT\n"))
-		return fmc, nil
-	}
-}
-
-func (fmc *FireMpqClient) GetVersion() string {
-	return fmc.version
-}
-
-func (fmc *FireMpqClient) makeConn() (net.Conn, *bufio.Writer, *TokenReader, error) {
-	conn, err := fmc.connFactory()
-	if err != nil {
-		return nil, nil, nil, err
-	}
-
-	tokReader := NewTokenReader(conn)
-	connHdr, err := tokReader.ReadTokens()
-
-	if err != nil {
-		return nil, nil, nil, err
-	}
-
-	if len(connHdr) == 2 && connHdr[0] == "+HELLO" {
-		// TODO(vburenin): Add version check and log warning if version accidentally changes.
-		fmc.version = connHdr[1]
-	} else {
-		return nil, nil, nil, NewFireMpqError(-3, fmt.Sprintf("Unexpected hello string: %s", connHdr))
-	}
-	bufWriter := bufio.NewWriter(conn)
-	return conn, bufWriter, tokReader, nil
-}
-
-func (fmc *FireMpqClient) GetPQueue(queueName string) (*PriorityQueue, error) {
-	_, bufWriter, tokReader, err := fmc.makeConn()
-	if err != nil {
-		return nil, err
-	}
-	return SetPQueueContext(queueName, bufWriter, tokReader)
-}
-
-func (fmc *FireMpqClient) CreatePQueue(queueName string, opts *PqParams) (*PriorityQueue, error) {
-	_, bufWriter, tokReader, err := fmc.makeConn()
-	if err != nil {
-		return nil, err
-	}
-	return CreatePQueue(queueName, bufWriter, tokReader, opts)
-}
-
 var last_ts int64
 var lck sync.Mutex
 var counter int64
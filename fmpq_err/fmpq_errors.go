@@ -1,6 +1,9 @@
 package fmpq_err
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 type FireMpqError struct {
 	Code int64
@@ -30,3 +33,32 @@ func UnexpectedResponse(tokens []string) *FireMpqError {
 func WrongMessageFormatError(msg string) *FireMpqError {
 	return NewFireMpqError(-4, msg)
 }
+
+// IsQueueFull returns true if error reports that the queue has reached its max size.
+func IsQueueFull(err error) bool {
+	if e, ok := err.(*FireMpqError); ok {
+		desc := strings.ToLower(e.Desc)
+		return strings.Contains(desc, "size exceeded") || strings.Contains(desc, "queue is full")
+	}
+	return false
+}
+
+// IsIdConflict returns true if error reports that a message with the same id already exists.
+func IsIdConflict(err error) bool {
+	if e, ok := err.(*FireMpqError); ok {
+		if e.Code == 409 {
+			return true
+		}
+		desc := strings.ToLower(e.Desc)
+		return strings.Contains(desc, "already exists") || strings.Contains(desc, "same id")
+	}
+	return false
+}
+
+// IsUnknownCommand returns true if error reports that the service doesn't support a command.
+func IsUnknownCommand(err error) bool {
+	if e, ok := err.(*FireMpqError); ok {
+		return strings.Contains(strings.ToLower(e.Desc), "unknown command")
+	}
+	return false
+}
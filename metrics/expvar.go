@@ -0,0 +1,207 @@
+package metrics
+
+import (
+	"bytes"
+	"expvar"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are upper bounds of latency histogram buckets in milliseconds.
+var latencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+// Histogram is a fixed bucket latency histogram exported as JSON through expvar.
+type Histogram struct {
+	mu     sync.Mutex
+	counts []int64
+	count  int64
+	sumMs  float64
+}
+
+func newHistogram() *Histogram {
+	return &Histogram{counts: make([]int64, len(latencyBuckets)+1)}
+}
+
+// Observe adds a single duration to the histogram.
+func (h *Histogram) Observe(d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+	idx := len(latencyBuckets)
+	for i, b := range latencyBuckets {
+		if ms <= b {
+			idx = i
+			break
+		}
+	}
+	h.mu.Lock()
+	h.counts[idx]++
+	h.count++
+	h.sumMs += ms
+	h.mu.Unlock()
+}
+
+// String implements expvar.Var. Bucket values are cumulative like in Prometheus.
+func (h *Histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var b bytes.Buffer
+	b.WriteString(`{"count":`)
+	b.WriteString(strconv.FormatInt(h.count, 10))
+	b.WriteString(`,"sum_ms":`)
+	b.WriteString(strconv.FormatFloat(h.sumMs, 'f', -1, 64))
+	b.WriteString(`,"buckets":{`)
+	var total int64
+	for i, c := range h.counts {
+		total += c
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		if i < len(latencyBuckets) {
+			b.WriteString(`"`)
+			b.WriteString(strconv.FormatFloat(latencyBuckets[i], 'f', -1, 64))
+			b.WriteString(`":`)
+		} else {
+			b.WriteString(`"+Inf":`)
+		}
+		b.WriteString(strconv.FormatInt(total, 10))
+	}
+	b.WriteString("}}")
+	return b.String()
+}
+
+// ExpvarMetrics is a Metrics implementation publishing all values through expvar.
+// Per command values are keyed as "queue.cmd", errors as "queue.cmd.code".
+type ExpvarMetrics struct {
+	mu          sync.Mutex
+	commands    *expvar.Map
+	errors      *expvar.Map
+	latency     *expvar.Map
+	popCalls    *expvar.Map
+	popped      *expvar.Map
+	bytesOut    *expvar.Map
+	bytesIn     *expvar.Map
+	rawBytes    *expvar.Map
+	compBytes   *expvar.Map
+	blocked     *expvar.Map
+	blockedMs   *expvar.Map
+	spilled     *expvar.Map
+	connections *expvar.Int
+	connErrors  *expvar.Int
+	connLost    *expvar.Map
+}
+
+// NewExpvarMetrics creates metrics published as a single expvar map with the given name.
+// As any other expvar, the name must be unique within the process.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	m := &ExpvarMetrics{
+		commands:    new(expvar.Map).Init(),
+		errors:      new(expvar.Map).Init(),
+		latency:     new(expvar.Map).Init(),
+		popCalls:    new(expvar.Map).Init(),
+		popped:      new(expvar.Map).Init(),
+		bytesOut:    new(expvar.Map).Init(),
+		bytesIn:     new(expvar.Map).Init(),
+		rawBytes:    new(expvar.Map).Init(),
+		compBytes:   new(expvar.Map).Init(),
+		blocked:     new(expvar.Map).Init(),
+		blockedMs:   new(expvar.Map).Init(),
+		spilled:     new(expvar.Map).Init(),
+		connections: new(expvar.Int),
+		connErrors:  new(expvar.Int),
+		connLost:    new(expvar.Map).Init(),
+	}
+	root := expvar.NewMap(name)
+	root.Set("commands", m.commands)
+	root.Set("errors", m.errors)
+	root.Set("latency", m.latency)
+	root.Set("pop_calls", m.popCalls)
+	root.Set("popped", m.popped)
+	root.Set("bytes_out", m.bytesOut)
+	root.Set("bytes_in", m.bytesIn)
+	root.Set("compression_raw_bytes", m.rawBytes)
+	root.Set("compression_bytes", m.compBytes)
+	root.Set("compression_ratio", expvar.Func(m.compressionRatio))
+	root.Set("push_blocked", m.blocked)
+	root.Set("push_blocked_ms", m.blockedMs)
+	root.Set("push_spilled", m.spilled)
+	root.Set("connections", m.connections)
+	root.Set("connection_errors", m.connErrors)
+	root.Set("connections_lost", m.connLost)
+	return m
+}
+
+func (m *ExpvarMetrics) histogram(key string) *Histogram {
+	if h, ok := m.latency.Get(key).(*Histogram); ok {
+		return h
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if h, ok := m.latency.Get(key).(*Histogram); ok {
+		return h
+	}
+	h := newHistogram()
+	m.latency.Set(key, h)
+	return h
+}
+
+func (m *ExpvarMetrics) CommandDone(queue, cmd string, duration time.Duration, err error) {
+	key := queue + "." + cmd
+	m.commands.Add(key, 1)
+	m.histogram(key).Observe(duration)
+	if err != nil {
+		m.errors.Add(key+"."+ErrorCode(err), 1)
+	}
+}
+
+func (m *ExpvarMetrics) MessagesPopped(queue, cmd string, count int) {
+	key := queue + "." + cmd
+	m.popCalls.Add(key, 1)
+	m.popped.Add(key, int64(count))
+}
+
+func (m *ExpvarMetrics) PayloadBytesOut(queue string, n int) {
+	m.bytesOut.Add(queue, int64(n))
+}
+
+func (m *ExpvarMetrics) PayloadBytesIn(queue string, n int) {
+	m.bytesIn.Add(queue, int64(n))
+}
+
+func (m *ExpvarMetrics) PayloadCompressed(queue, algo string, rawBytes, compressedBytes int) {
+	key := queue + "." + algo
+	m.rawBytes.Add(key, int64(rawBytes))
+	m.compBytes.Add(key, int64(compressedBytes))
+}
+
+// compressionRatio returns raw to compressed bytes ratio for each "queue.algo" key.
+func (m *ExpvarMetrics) compressionRatio() any {
+	ratio := make(map[string]float64)
+	m.rawBytes.Do(func(kv expvar.KeyValue) {
+		raw := kv.Value.(*expvar.Int).Value()
+		if c, ok := m.compBytes.Get(kv.Key).(*expvar.Int); ok && c.Value() > 0 {
+			ratio[kv.Key] = float64(raw) / float64(c.Value())
+		}
+	})
+	return ratio
+}
+
+func (m *ExpvarMetrics) PushBlocked(queue string, duration time.Duration) {
+	m.blocked.Add(queue, 1)
+	m.blockedMs.AddFloat(queue, float64(duration)/float64(time.Millisecond))
+}
+
+func (m *ExpvarMetrics) PushSpilled(queue, fallback string, count int) {
+	m.spilled.Add(queue+"."+fallback, int64(count))
+}
+
+func (m *ExpvarMetrics) ConnectionOpened() {
+	m.connections.Add(1)
+}
+
+func (m *ExpvarMetrics) ConnectionFailed() {
+	m.connErrors.Add(1)
+}
+
+func (m *ExpvarMetrics) ConnectionLost(queue string) {
+	m.connLost.Add(queue, 1)
+}
@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	. "github.com/vburenin/firempq_connector/fmpq_err"
+)
+
+// Metrics receives instrumentation events from the client. All methods take label
+// values first and a single observed value last, so they map directly onto
+// Prometheus CounterVec/HistogramVec instances when an adapter is needed.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// CommandDone is called when a queue command completes, successfully or not.
+	CommandDone(queue, cmd string, duration time.Duration, err error)
+	// MessagesPopped reports the number of messages returned by a single POP/POPLCK call.
+	MessagesPopped(queue, cmd string, count int)
+	// PayloadBytesOut reports the size of payloads pushed into the queue.
+	PayloadBytesOut(queue string, n int)
+	// PayloadBytesIn reports the size of payloads received from the queue.
+	PayloadBytesIn(queue string, n int)
+	// PayloadCompressed reports payload size before and after compression.
+	PayloadCompressed(queue, algo string, rawBytes, compressedBytes int)
+	// PushBlocked reports time a push spent waiting for free space in a full queue.
+	PushBlocked(queue string, duration time.Duration)
+	// PushSpilled reports the number of messages pushed into a fallback queue because queue was full.
+	PushSpilled(queue, fallback string, count int)
+	// ConnectionOpened is called every time a new connection to the service is established.
+	ConnectionOpened()
+	// ConnectionFailed is called every time a connection attempt fails.
+	ConnectionFailed()
+	// ConnectionLost is called when a queue connection becomes unusable because of an I/O
+	// error or a malformed response. The client never reconnects on its own, a lost connection
+	// is replaced by opening a new queue, which reports ConnectionOpened. So reconnects are
+	// counted by ConnectionLost.
+	ConnectionLost(queue string)
+}
+
+// ErrorCode returns a label value for the error: FireMpqError code, "io" for any other
+// error and an empty string if there is no error.
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	if e, ok := err.(*FireMpqError); ok {
+		return strconv.FormatInt(e.Code, 10)
+	}
+	return "io"
+}
+
+// NopMetrics discards all events.
+type NopMetrics struct{}
+
+func (NopMetrics) CommandDone(queue, cmd string, duration time.Duration, err error)    {}
+func (NopMetrics) MessagesPopped(queue, cmd string, count int)                         {}
+func (NopMetrics) PayloadBytesOut(queue string, n int)                                 {}
+func (NopMetrics) PayloadBytesIn(queue string, n int)                                  {}
+func (NopMetrics) PayloadCompressed(queue, algo string, rawBytes, compressedBytes int) {}
+func (NopMetrics) PushBlocked(queue string, duration time.Duration)                    {}
+func (NopMetrics) PushSpilled(queue, fallback string, count int)                       {}
+func (NopMetrics) ConnectionOpened()                                                   {}
+func (NopMetrics) ConnectionFailed()                                                   {}
+func (NopMetrics) ConnectionLost(queue string)                                         {}
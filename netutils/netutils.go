@@ -1,6 +1,13 @@
 package netutils
 
-import "bufio"
+import (
+	"bufio"
+
+	. "github.com/vburenin/firempq_connector/encoders"
+)
+
+// maxArgPrefixLen is enough to fit a space and either a string length prefix or an integer.
+const maxArgPrefixLen = 24
 
 func CompleteWrite(writer *bufio.Writer) error {
 	writer.WriteByte('\n')
@@ -30,3 +37,33 @@ func WriteData(writer *bufio.Writer, cmd string, data [][]byte) (err error) {
 	}
 	return err
 }
+
+// WriteArg writes a space separated raw argument such as a parameter name.
+func WriteArg(writer *bufio.Writer, arg []byte) {
+	writer.WriteByte(' ')
+	writer.Write(arg)
+}
+
+// WriteStringArg writes a space separated encoded string without intermediate allocations.
+func WriteStringArg(writer *bufio.Writer, v string) {
+	buf := scratch(writer)
+	buf = append(buf, ' ')
+	writer.Write(AppendStringPrefix(buf, v))
+	writer.WriteString(v)
+}
+
+// WriteIntArg writes a space separated encoded integer without intermediate allocations.
+func WriteIntArg(writer *bufio.Writer, v int64) {
+	buf := scratch(writer)
+	buf = append(buf, ' ')
+	writer.Write(AppendInt64(buf, v))
+}
+
+// scratch returns an empty slice of the writer buffer free space flushing the buffer
+// if there is not enough space for an argument prefix.
+func scratch(writer *bufio.Writer) []byte {
+	if writer.Available() < maxArgPrefixLen {
+		writer.Flush()
+	}
+	return writer.AvailableBuffer()
+}
@@ -3,7 +3,7 @@ package parsers
 import . "github.com/vburenin/firempq_connector/fmpq_err"
 
 func ParseError(tokens []string) error {
-	if tokens[0] == "-ERR" {
+	if len(tokens) > 0 && tokens[0] == "-ERR" {
 		if len(tokens) < 3 {
 			return UnexpectedErrorFormat(tokens)
 		}
@@ -10,7 +10,7 @@ func HandleOk(tokReader ITokenReader) error {
 	if err != nil {
 		return err
 	}
-	if tokens[0] == "+OK" {
+	if len(tokens) > 0 && tokens[0] == "+OK" {
 		return nil
 	}
 	if err := ParseError(tokens); err != nil {
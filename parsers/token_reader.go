@@ -5,12 +5,11 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"strings"
 )
 
 const (
-	stateParseTextToken     = 1
-	stateParseBinaryPayload = 2
-	symbolCr                = 0x0A
+	symbolCr = 0x0A
 )
 
 const (
@@ -19,15 +18,37 @@ const (
 	startAsciiRange    = 0x21
 	endAsciiRange      = 0x7E
 	initTokenBufferLen = 48
+	maxKeptResultLen   = 1024
+	maxTextTokenLen    = 1024 * 1024
 )
 
 var ErrTokParsingError = errors.New("Error during token parsing")
 
+// ProtocolError reports a malformed response at the given byte offset of the connection stream.
+// It matches ErrTokParsingError with errors.Is.
+type ProtocolError struct {
+	Offset int64
+	Desc   string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error at byte " + strconv.FormatInt(e.Offset, 10) + ": " + e.Desc
+}
+
+func (e *ProtocolError) Is(target error) bool {
+	return target == ErrTokParsingError
+}
+
+// TokenReader splits service responses into tokens. Text tokens are collected in a reusable
+// buffer and frequent ones are interned, binary tokens are copied once into their strings.
 type TokenReader struct {
 	buffer []byte
 	bufPos int
 	bufLen int
 	reader io.Reader
+	token  []byte
+	result []string
+	offset int64
 }
 
 func NewTokenReader(conn net.Conn) *TokenReader {
@@ -36,74 +57,173 @@ func NewTokenReader(conn net.Conn) *TokenReader {
 		bufPos: 0,
 		bufLen: 0,
 		reader: conn,
+		token:  make([]byte, 0, initTokenBufferLen),
 	}
 	return &tok
 }
 
-func (tok *TokenReader) ReadTokens() ([]string, error) {
-	var err error
-	var token []byte = make([]byte, 0, initTokenBufferLen)
-	var binTokenLen int
-	var state int = stateParseTextToken
-
-	result := make([]string, 0, 4)
+// Offset returns the number of bytes consumed from the connection.
+func (tok *TokenReader) Offset() int64 {
+	return tok.offset + int64(tok.bufPos)
+}
 
+// ReadTokens reads all tokens of a response. Returned slice is reused and is only
+// valid until the next ReadTokens call, tokens themselves can be kept.
+func (tok *TokenReader) ReadTokens() ([]string, error) {
+	clear(tok.result)
+	if cap(tok.result) > maxKeptResultLen {
+		tok.result = nil
+	}
+	result := tok.result[:0]
 	for {
-		if tok.bufPos >= tok.bufLen {
-			// Read more data from the network reader
-			tok.bufPos = 0
-			tok.bufLen, err = tok.reader.Read(tok.buffer)
-			if nil != err {
-				return nil, err
-			}
+		t, last, err := tok.ReadToken()
+		if err != nil {
+			return nil, err
+		}
+		if t != "" {
+			result = append(result, t)
 		}
+		if last {
+			tok.result = result
+			return result, nil
+		}
+	}
+}
 
-		// Tokenize content of the buffer
+// ReadToken reads the next response token.
+func (tok *TokenReader) ReadToken() (string, bool, error) {
+	token := tok.token[:0]
+	for {
+		if err := tok.fill(); err != nil {
+			return "", false, err
+		}
 		for tok.bufPos < tok.bufLen {
-			if state == stateParseBinaryPayload {
-				availableBytes := tok.bufLen - tok.bufPos
-				if availableBytes > binTokenLen {
-					availableBytes = binTokenLen
-				}
-				token = append(token, tok.buffer[tok.bufPos:tok.bufPos+availableBytes]...)
-				binTokenLen -= availableBytes
-
-				tok.bufPos += availableBytes
-
-				if binTokenLen <= 0 {
-					// Binary token complete
-					state = stateParseTextToken
-					result = append(result, string(token))
-					token = make([]byte, 0, initTokenBufferLen)
-				}
-				continue
-			}
-
 			val := tok.buffer[tok.bufPos]
-			tok.bufPos += 1
+			tok.bufPos++
 
 			if val >= startAsciiRange && val <= endAsciiRange {
-				token = append(token, val)
-			} else if len(token) > 0 {
-				if token[0] == '$' {
-					binTokenLen, err = strconv.Atoi(string(token[1:]))
-					if err == nil && (binTokenLen < 1 || binTokenLen > maxBinaryTokenLen) {
-						return nil, ErrTokParsingError
-					}
-					state = stateParseBinaryPayload
-					token = make([]byte, 0, binTokenLen)
-				} else {
-					result = append(result, string(token))
-					if val == symbolCr {
-						return result, nil
-					}
-					token = make([]byte, 0, initTokenBufferLen)
+				if len(token) >= maxTextTokenLen {
+					return "", false, tok.protocolError("Text token is too long")
 				}
-			} else {
+				token = append(token, val)
+				continue
+			}
+			if len(token) == 0 {
 				if val == symbolCr {
-					return result, nil
+					return "", true, nil
 				}
+				continue
+			}
+			tok.token = token
+			if token[0] == '$' {
+				return tok.readBinary(token[1:])
 			}
+			return intern(token), val == symbolCr, nil
+		}
+	}
+}
+
+// readBinary reads a binary token of the given length and the delimiter following it.
+func (tok *TokenReader) readBinary(size []byte) (string, bool, error) {
+	binTokenLen := 0
+	for _, c := range size {
+		if c < '0' || c > '9' || binTokenLen > maxBinaryTokenLen {
+			return "", false, tok.protocolError("Invalid binary token length: " + string(size))
 		}
+		binTokenLen = binTokenLen*10 + int(c-'0')
+	}
+	if binTokenLen < 1 || binTokenLen > maxBinaryTokenLen {
+		return "", false, tok.protocolError("Binary token length out of range: " + string(size))
+	}
+
+	var sb strings.Builder
+	sb.Grow(binTokenLen)
+	for binTokenLen > 0 {
+		if err := tok.fill(); err != nil {
+			return "", false, err
+		}
+		n := tok.bufLen - tok.bufPos
+		if n > binTokenLen {
+			n = binTokenLen
+		}
+		sb.Write(tok.buffer[tok.bufPos : tok.bufPos+n])
+		tok.bufPos += n
+		binTokenLen -= n
+	}
+
+	if err := tok.fill(); err != nil {
+		return "", false, err
+	}
+	last := tok.buffer[tok.bufPos] == symbolCr
+	if last || tok.buffer[tok.bufPos] < startAsciiRange || tok.buffer[tok.bufPos] > endAsciiRange {
+		tok.bufPos++
+	}
+	return sb.String(), last, nil
+}
+
+// fill reads more data from the network if the buffer has been consumed.
+func (tok *TokenReader) fill() error {
+	if tok.bufPos < tok.bufLen {
+		return nil
+	}
+	var err error
+	tok.offset += int64(tok.bufLen)
+	tok.bufPos = 0
+	tok.bufLen, err = tok.reader.Read(tok.buffer)
+	if tok.bufLen > 0 {
+		return nil
+	}
+	if err == nil {
+		err = io.ErrNoProgress
+	}
+	return err
+}
+
+func (tok *TokenReader) protocolError(desc string) *ProtocolError {
+	return &ProtocolError{Offset: tok.Offset(), Desc: desc}
+}
+
+// intern returns a string for a token avoiding allocations for frequent response tokens.
+func intern(token []byte) string {
+	switch string(token) {
+	case "+OK":
+		return "+OK"
+	case "+MSGS":
+		return "+MSGS"
+	case "+MSG":
+		return "+MSG"
+	case "+BATCH":
+		return "+BATCH"
+	case "-ERR":
+		return "-ERR"
+	case "ID":
+		return "ID"
+	case "PL":
+		return "PL"
+	case "RCPT":
+		return "RCPT"
+	case "ETS":
+		return "ETS"
+	case "UTS":
+		return "UTS"
+	case "POPCNT":
+		return "POPCNT"
+	case "*0":
+		return "*0"
+	case "*1":
+		return "*1"
+	case "%4":
+		return "%4"
+	case "%5":
+		return "%5"
+	case "%6":
+		return "%6"
+	case "0":
+		return "0"
+	case "1":
+		return "1"
+	case "2":
+		return "2"
 	}
+	return string(token)
 }
@@ -0,0 +1,54 @@
+package parsers
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// readerConn is a connection reading responses from r.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readerConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func FuzzTokenReader(f *testing.F) {
+	f.Add("+OK\n")
+	f.Add("+MSG 123\n-ERR 404 $9 Not found\n")
+	f.Add("+MSGS *1 %3 ID a PL $5 hello POPCNT :1\n")
+	f.Add("+MSGS *1 %1 PL $3 a\nb\n")
+	f.Add("+BATCH *2\n+MSG a\n-ERR 409 $3 dup\n")
+	f.Add("$0 \n$-1\n$12x\n")
+	f.Fuzz(func(t *testing.T, data string) {
+		tok := NewTokenReader(readerConn{r: strings.NewReader(data)})
+		// Every response consumes at least one byte, so the loop ends.
+		for i := 0; i <= len(data); i++ {
+			tokens, err := tok.ReadTokens()
+			if offset := tok.Offset(); offset > int64(len(data)) {
+				t.Fatalf("Offset %d is beyond %d bytes of data", offset, len(data))
+			}
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				var pe *ProtocolError
+				if !errors.As(err, &pe) || !errors.Is(err, ErrTokParsingError) {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return
+			}
+			for _, token := range tokens {
+				if token == "" {
+					t.Fatalf("Empty token in %q", tokens)
+				}
+			}
+		}
+		t.Fatalf("Reader doesn't consume data")
+	})
+}
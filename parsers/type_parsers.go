@@ -7,7 +7,7 @@ import (
 )
 
 func ParseInt(v string) (int64, error) {
-	if v[0] == ':' {
+	if len(v) > 0 && v[0] == ':' {
 		v = v[1:]
 	}
 
@@ -18,22 +18,21 @@ func ParseInt(v string) (int64, error) {
 	return 0, WrongDataFormatError("int type", v)
 }
 
+// ParseArraySize parses array header. Negative sizes are rejected.
 func ParseArraySize(v string) (int64, error) {
-	if v[0] == '*' {
-		if v, err := strconv.ParseInt(v[1:], 10, 0); err == nil {
-			return v, nil
-		}
-	}
-
-	return 0, WrongDataFormatError("array size", v)
+	return parseSize(v, '*', "array size")
 }
 
+// ParseMapSize parses map header. Negative sizes are rejected.
 func ParseMapSize(v string) (int64, error) {
-	if v[0] == '%' {
-		if v, err := strconv.ParseInt(v[1:], 10, 0); err == nil {
-			return v, nil
+	return parseSize(v, '%', "map size")
+}
+
+func parseSize(v string, prefix byte, dataType string) (int64, error) {
+	if len(v) > 1 && v[0] == prefix {
+		if n, err := strconv.ParseInt(v[1:], 10, 0); err == nil && n >= 0 {
+			return n, nil
 		}
 	}
-
-	return 0, WrongDataFormatError("map size", v)
+	return 0, WrongDataFormatError(dataType, v)
 }
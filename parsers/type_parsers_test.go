@@ -0,0 +1,43 @@
+package parsers
+
+import (
+	"strconv"
+	"testing"
+)
+
+func FuzzParseArraySize(f *testing.F) {
+	f.Add("*0")
+	f.Add("*10")
+	f.Add("*-1")
+	f.Add("*")
+	f.Add("%2")
+	f.Add("*9223372036854775808")
+	f.Fuzz(func(t *testing.T, v string) {
+		n, err := ParseArraySize(v)
+		if err != nil {
+			return
+		}
+		if n < 0 {
+			t.Fatalf("Negative size %d parsed from %q", n, v)
+		}
+		if v[0] != '*' {
+			t.Fatalf("Size %d parsed from %q without array prefix", n, v)
+		}
+		if m, err := strconv.ParseInt(v[1:], 10, 64); err != nil || m != n {
+			t.Fatalf("Size %d parsed from %q", n, v)
+		}
+	})
+}
+
+func FuzzParseMapSize(f *testing.F) {
+	f.Add("%0")
+	f.Add("%3")
+	f.Add("%-3")
+	f.Add("*3")
+	f.Fuzz(func(t *testing.T, v string) {
+		n, err := ParseMapSize(v)
+		if err == nil && (n < 0 || v[0] != '%') {
+			t.Fatalf("Size %d parsed from %q", n, v)
+		}
+	})
+}
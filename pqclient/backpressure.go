@@ -0,0 +1,164 @@
+package pqclient
+
+import (
+	"context"
+	"time"
+
+	. "github.com/vburenin/firempq_connector/fmpq_err"
+)
+
+// FullQueuePolicy defines what Push and PushBatch do if the queue has reached
+// its max size, see PqParams.SetMaxSize.
+type FullQueuePolicy struct {
+	fallback       *PriorityQueue
+	initialBackoff int64
+	maxBackoff     int64
+}
+
+// NewBlockOnFullQueue returns a policy blocking push with exponential backoff until
+// there is space in the queue or message context is done.
+func NewBlockOnFullQueue() *FullQueuePolicy {
+	return &FullQueuePolicy{initialBackoff: 10, maxBackoff: 1000}
+}
+
+// NewSpillOnFullQueue returns a policy pushing messages into a fallback queue if the queue is full.
+// Fallback queue must not be used by any other goroutine.
+func NewSpillOnFullQueue(fallback *PriorityQueue) *FullQueuePolicy {
+	return &FullQueuePolicy{fallback: fallback}
+}
+
+// SetBackoff sets initial and max wait time in milliseconds between push attempts
+// into a full queue. Values must be positive.
+func (p *FullQueuePolicy) SetBackoff(initial, max int64) *FullQueuePolicy {
+	if initial <= 0 || max <= 0 {
+		panic("Value must be positive")
+	}
+	p.initialBackoff = initial
+	p.maxBackoff = max
+	return p
+}
+
+// SetFullQueuePolicy sets a policy applied when pushes fail because the queue is full.
+// Nil policy returns queue full errors to the caller.
+func (pq *PriorityQueue) SetFullQueuePolicy(p *FullQueuePolicy) *PriorityQueue {
+	pq.fullQueuePolicy = p
+	return pq
+}
+
+// push retries a message rejected because the queue is full. Blocking retries send
+// the payload encoded by the first attempt.
+func (p *FullQueuePolicy) push(pq *PriorityQueue, msg *Message, payload *string) error {
+	if p.fallback != nil {
+		// Fallback queue encodes the message with its own settings.
+		pq.dropPayload(payload)
+		err := p.fallback.Push(msg)
+		if err == nil {
+			pq.metrics.PushSpilled(pq.queueName, p.fallback.GetName(), 1)
+		}
+		return err
+	}
+
+	ctx := msg.context()
+	start := time.Now()
+	defer func() { pq.metrics.PushBlocked(pq.queueName, time.Since(start)) }()
+	backoff := p.initialBackoff
+	for {
+		if err := p.wait(ctx, &backoff); err != nil {
+			pq.dropPayload(payload)
+			return err
+		}
+		if err := pq.push(msg, payload); !IsQueueFull(err) {
+			return err
+		}
+	}
+}
+
+// pushBatch retries messages rejected because the queue is full updating their items in place.
+// Blocking retries send payloads encoded by the first attempt.
+func (p *FullQueuePolicy) pushBatch(ctx context.Context, pq *PriorityQueue, msgs []*Message, payloads []string,
+	items []PushBatchItem) error {
+	pending := fullItems(items)
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if p.fallback != nil {
+		retry := make([]*Message, len(pending))
+		for i, idx := range pending {
+			retry[i] = msgs[idx]
+			// Fallback queue encodes messages with its own settings.
+			pq.dropPayload(&payloads[idx])
+		}
+		res, err := p.fallback.PushBatch(retry...)
+		if err != nil {
+			return err
+		}
+		spilled := 0
+		for i, idx := range pending {
+			if i < len(res) {
+				items[idx] = res[i]
+				if res[i].Error == nil {
+					spilled++
+				}
+			}
+		}
+		pq.metrics.PushSpilled(pq.queueName, p.fallback.GetName(), spilled)
+		return nil
+	}
+
+	start := time.Now()
+	defer func() { pq.metrics.PushBlocked(pq.queueName, time.Since(start)) }()
+	backoff := p.initialBackoff
+	for len(pending) > 0 {
+		if err := p.wait(ctx, &backoff); err != nil {
+			return err
+		}
+		retry := make([]*Message, len(pending))
+		retryPayloads := make([]string, len(pending))
+		for i, idx := range pending {
+			retry[i] = msgs[idx]
+			retryPayloads[i] = payloads[idx]
+		}
+		res, err := pq.pushBatch(ctx, retry, retryPayloads)
+		if err != nil {
+			return err
+		}
+		still := pending[:0]
+		for i, idx := range pending {
+			if i < len(res) {
+				items[idx] = res[i]
+			}
+			if IsQueueFull(items[idx].Error) {
+				still = append(still, idx)
+			}
+		}
+		pending = still
+	}
+	return nil
+}
+
+// wait sleeps for the current backoff time doubling it for the next attempt.
+func (p *FullQueuePolicy) wait(ctx context.Context, backoff *int64) error {
+	t := time.NewTimer(time.Duration(*backoff) * time.Millisecond)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	*backoff *= 2
+	if *backoff > p.maxBackoff {
+		*backoff = p.maxBackoff
+	}
+	return nil
+}
+
+func fullItems(items []PushBatchItem) []int {
+	var idx []int
+	for i, item := range items {
+		if IsQueueFull(item.Error) {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
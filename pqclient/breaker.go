@@ -0,0 +1,238 @@
+package pqclient
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// BreakerState is a state of a circuit breaker.
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitOpenError is returned without contacting the service while circuit breaker is open.
+type CircuitOpenError struct {
+	Name       string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return "Circuit breaker " + e.Name + " is open, retry after " + e.RetryAfter.String()
+}
+
+// BreakerSettings configure circuit breakers, see ClientOptions.SetCircuitBreaker.
+type BreakerSettings struct {
+	maxConsecutiveFailures int64
+	errorRate              float64
+	minRequests            int64
+	window                 int64
+	openTimeout            int64
+	probes                 int64
+	perQueue               bool
+}
+
+// NewBreakerSettings returns settings tripping the breaker after 5 consecutive failures.
+// Error rate threshold is disabled. Breaker stays open for 5 seconds and closes after
+// a single successful probe.
+func NewBreakerSettings() *BreakerSettings {
+	return &BreakerSettings{
+		maxConsecutiveFailures: 5,
+		minRequests:            20,
+		window:                 10000,
+		openTimeout:            5000,
+		probes:                 1,
+	}
+}
+
+// SetMaxConsecutiveFailures sets the number of consecutive failures tripping the breaker.
+// Zero disables this threshold.
+func (s *BreakerSettings) SetMaxConsecutiveFailures(v int64) *BreakerSettings {
+	if v < 0 {
+		panic("Value must be positive")
+	}
+	s.maxConsecutiveFailures = v
+	return s
+}
+
+// SetErrorRate sets failure rate in (0, 1] range tripping the breaker once at least
+// minRequests have been made within a window of given milliseconds. Zero rate disables this threshold.
+func (s *BreakerSettings) SetErrorRate(rate float64, minRequests, window int64) *BreakerSettings {
+	if rate < 0 || rate > 1 {
+		panic("Rate must be in [0, 1] range")
+	}
+	if minRequests < 1 || window < 1 {
+		panic("Value must be positive")
+	}
+	s.errorRate = rate
+	s.minRequests = minRequests
+	s.window = window
+	return s
+}
+
+// SetOpenTimeout sets time in milliseconds breaker stays open before letting probe requests through.
+func (s *BreakerSettings) SetOpenTimeout(v int64) *BreakerSettings {
+	if v < 1 {
+		panic("Value must be positive")
+	}
+	s.openTimeout = v
+	return s
+}
+
+// SetProbes sets the number of successful probe requests needed to close half open breaker.
+func (s *BreakerSettings) SetProbes(v int64) *BreakerSettings {
+	if v < 1 {
+		panic("Value must be positive")
+	}
+	s.probes = v
+	return s
+}
+
+// SetPerQueue enables a separate breaker for each queue in addition to client wide breaker
+// used for new connections.
+func (s *BreakerSettings) SetPerQueue(b bool) *BreakerSettings {
+	s.perQueue = b
+	return s
+}
+
+// CircuitBreaker stops calls to the service after failures for a while. Only I/O failures
+// are counted, errors returned by the service itself mean it is alive.
+type CircuitBreaker struct {
+	name     string
+	settings BreakerSettings
+
+	lock        sync.Mutex
+	state       BreakerState
+	consecutive int64
+	windowStart time.Time
+	requests    int64
+	failures    int64
+	openedAt    time.Time
+	inProbe     int64
+	probeOk     int64
+}
+
+func newCircuitBreaker(name string, settings *BreakerSettings) *CircuitBreaker {
+	return &CircuitBreaker{name: name, settings: *settings, windowStart: time.Now()}
+}
+
+// State returns the current breaker state.
+func (b *CircuitBreaker) State() BreakerState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.checkTimeout(time.Now())
+	return b.state
+}
+
+// Allow returns CircuitOpenError if call must not be made. Every allowed call must be
+// completed with Done.
+func (b *CircuitBreaker) Allow() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	b.checkTimeout(now)
+	switch b.state {
+	case BreakerOpen:
+		retryAfter := b.openedAt.Add(time.Duration(b.settings.openTimeout) * time.Millisecond).Sub(now)
+		return &CircuitOpenError{Name: b.name, RetryAfter: retryAfter}
+	case BreakerHalfOpen:
+		if b.inProbe+b.probeOk >= b.settings.probes {
+			return &CircuitOpenError{Name: b.name}
+		}
+		b.inProbe++
+	}
+	return nil
+}
+
+// Done records the result of an allowed call.
+func (b *CircuitBreaker) Done(err error) {
+	failed := isIoFailure(err)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+
+	if b.state == BreakerHalfOpen {
+		if b.inProbe > 0 {
+			b.inProbe--
+		}
+		if failed {
+			b.open(now)
+		} else if b.probeOk++; b.probeOk >= b.settings.probes {
+			b.close(now)
+		}
+		return
+	}
+	if b.state == BreakerOpen {
+		return
+	}
+
+	if now.Sub(b.windowStart) > time.Duration(b.settings.window)*time.Millisecond {
+		b.windowStart = now
+		b.requests = 0
+		b.failures = 0
+	}
+	b.requests++
+	if !failed {
+		b.consecutive = 0
+		return
+	}
+	b.failures++
+	b.consecutive++
+	if b.settings.maxConsecutiveFailures > 0 && b.consecutive >= b.settings.maxConsecutiveFailures {
+		b.open(now)
+		return
+	}
+	if b.settings.errorRate > 0 && b.requests >= b.settings.minRequests &&
+		float64(b.failures)/float64(b.requests) >= b.settings.errorRate {
+		b.open(now)
+	}
+}
+
+func (b *CircuitBreaker) checkTimeout(now time.Time) {
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= time.Duration(b.settings.openTimeout)*time.Millisecond {
+		b.state = BreakerHalfOpen
+		b.inProbe = 0
+		b.probeOk = 0
+	}
+}
+
+func (b *CircuitBreaker) open(now time.Time) {
+	b.state = BreakerOpen
+	b.openedAt = now
+}
+
+func (b *CircuitBreaker) close(now time.Time) {
+	b.state = BreakerClosed
+	b.consecutive = 0
+	b.requests = 0
+	b.failures = 0
+	b.windowStart = now
+}
+
+// isIoFailure returns true for network errors including timeouts and closed connections.
+func isIoFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed)
+}
@@ -0,0 +1,135 @@
+package pqclient
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	. "github.com/vburenin/firempq_connector/fmpq_err"
+)
+
+// elapseOpenTimeout makes open breaker ready to let probes through.
+func elapseOpenTimeout(b *CircuitBreaker) {
+	b.lock.Lock()
+	b.openedAt = b.openedAt.Add(-time.Duration(b.settings.openTimeout) * time.Millisecond)
+	b.lock.Unlock()
+}
+
+func expectState(t *testing.T, b *CircuitBreaker, want BreakerState) {
+	t.Helper()
+	if s := b.State(); s != want {
+		t.Fatalf("Breaker is %v, want %v", s, want)
+	}
+}
+
+func TestCircuitBreakerStates(t *testing.T) {
+	b := newCircuitBreaker("test", NewBreakerSettings().SetMaxConsecutiveFailures(2).SetProbes(2))
+	expectState(t, b, BreakerClosed)
+
+	for i := 0; i < 2; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatal(err)
+		}
+		b.Done(io.EOF)
+	}
+	expectState(t, b, BreakerOpen)
+	var openErr *CircuitOpenError
+	if err := b.Allow(); !errors.As(err, &openErr) || openErr.RetryAfter <= 0 {
+		t.Fatalf("Got %v, want circuit open error", err)
+	}
+
+	elapseOpenTimeout(b)
+	expectState(t, b, BreakerHalfOpen)
+	if err := b.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	b.Done(io.ErrUnexpectedEOF)
+	expectState(t, b, BreakerOpen)
+
+	elapseOpenTimeout(b)
+	for i := 0; i < 2; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("Probe %d: %v", i, err)
+		}
+	}
+	if err := b.Allow(); !errors.As(err, &openErr) {
+		t.Fatalf("Got %v, want only 2 probes allowed", err)
+	}
+	b.Done(nil)
+	expectState(t, b, BreakerHalfOpen)
+	b.Done(nil)
+	expectState(t, b, BreakerClosed)
+
+	b.Allow()
+	b.Done(io.EOF)
+	expectState(t, b, BreakerClosed)
+}
+
+func TestCircuitBreakerErrorRate(t *testing.T) {
+	b := newCircuitBreaker("test", NewBreakerSettings().SetMaxConsecutiveFailures(0).SetErrorRate(0.5, 4, 60000))
+	for _, err := range []error{io.EOF, nil, io.EOF} {
+		b.Allow()
+		b.Done(err)
+	}
+	expectState(t, b, BreakerClosed)
+	b.Allow()
+	b.Done(io.EOF)
+	expectState(t, b, BreakerOpen)
+}
+
+func TestCircuitBreakerIgnoresRejections(t *testing.T) {
+	b := newCircuitBreaker("test", NewBreakerSettings().SetMaxConsecutiveFailures(1))
+	for _, err := range []error{
+		NewFireMpqError(404, "Receipt not found"),
+		NewFireMpqError(429, "Queue is full"),
+		WrongMessageFormatError("Bad message"),
+		errors.New("Some error"),
+	} {
+		b.Allow()
+		b.Done(err)
+		expectState(t, b, BreakerClosed)
+	}
+
+	pq, _ := testQueue("-ERR 404 $17 Receipt not found\n")
+	pq.breaker = b
+	if err := pq.DeleteByReceipt("r1"); !isRejected(err) {
+		t.Fatalf("Got %v, want rejection", err)
+	}
+	expectState(t, b, BreakerClosed)
+	if err := pq.DeleteByReceipt("r1"); err == nil {
+		t.Fatal("Delete succeeded on closed connection")
+	}
+	expectState(t, b, BreakerOpen)
+}
+
+func TestPerQueueBreakers(t *testing.T) {
+	settings := NewBreakerSettings().SetMaxConsecutiveFailures(1)
+	newClient := func() *FireMpqClient {
+		return &FireMpqClient{
+			opts:          NewClientOptions().SetCircuitBreaker(settings),
+			breaker:       newCircuitBreaker("address", settings),
+			queueBreakers: make(map[string]*CircuitBreaker),
+		}
+	}
+
+	fmc := newClient()
+	if b := fmc.queueBreaker("a"); b != fmc.breaker {
+		t.Fatal("Queues don't share client breaker")
+	}
+
+	settings.SetPerQueue(true)
+	fmc = newClient()
+	a, b := fmc.queueBreaker("a"), fmc.queueBreaker("b")
+	if a == fmc.breaker || a == b {
+		t.Fatal("Queues share a breaker")
+	}
+	if fmc.queueBreaker("a") != a {
+		t.Fatal("Connections to the same queue don't share its breaker")
+	}
+	a.Allow()
+	a.Done(io.EOF)
+	expectState(t, a, BreakerOpen)
+	expectState(t, b, BreakerClosed)
+	expectState(t, fmc.breaker, BreakerClosed)
+}
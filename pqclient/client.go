@@ -0,0 +1,274 @@
+package pqclient
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/vburenin/firempq_connector/envelope"
+	. "github.com/vburenin/firempq_connector/fmpq_err"
+	. "github.com/vburenin/firempq_connector/metrics"
+	. "github.com/vburenin/firempq_connector/parsers"
+	. "github.com/vburenin/firempq_connector/tracing"
+)
+
+type FireMpqClient struct {
+	connFactory func(ctx context.Context) (net.Conn, error)
+	opts        *ClientOptions
+
+	connsOpened  atomic.Int64
+	connFailures atomic.Int64
+	statsLock    sync.Mutex
+	version      string
+	lastErr      error
+	lastErrTime  time.Time
+
+	topicsLock sync.Mutex
+	topics     map[string]*Topic
+
+	breaker       *CircuitBreaker
+	breakersLock  sync.Mutex
+	queueBreakers map[string]*CircuitBreaker
+}
+
+// ClientOptions are used to configure client wide behavior.
+type ClientOptions struct {
+	metrics         Metrics
+	tracer          Tracer
+	compressor      Compressor
+	compressMinSize int
+	keyProvider     KeyProvider
+	blobStore       BlobStore
+	claimMinSize    int
+	blobGc          bool
+	breaker         *BreakerSettings
+	batchMaxCount   int
+	batchMaxBytes   int
+}
+
+// NewClientOptions returns default client options.
+func NewClientOptions() *ClientOptions {
+	return &ClientOptions{
+		metrics:       NopMetrics{},
+		batchMaxCount: DefaultBatchMaxCount,
+		batchMaxBytes: DefaultBatchMaxBytes,
+	}
+}
+
+// SetMetrics sets metrics collector used by the client and all its queues.
+func (opts *ClientOptions) SetMetrics(m Metrics) *ClientOptions {
+	if m == nil {
+		m = NopMetrics{}
+	}
+	opts.metrics = m
+	return opts
+}
+
+// SetTracer enables tracing. Each queue command is wrapped into a client span and
+// trace context of pushed messages is propagated to consumers through the payload envelope.
+func (opts *ClientOptions) SetTracer(t Tracer) *ClientOptions {
+	opts.tracer = t
+	return opts
+}
+
+// SetCompression sets default payload compression for all queues. See PriorityQueue.SetCompression.
+func (opts *ClientOptions) SetCompression(c Compressor, minSize int) *ClientOptions {
+	opts.compressor = c
+	opts.compressMinSize = minSize
+	return opts
+}
+
+// SetEncryption sets default payload encryption for all queues. See PriorityQueue.SetEncryption.
+func (opts *ClientOptions) SetEncryption(kp KeyProvider) *ClientOptions {
+	opts.keyProvider = kp
+	return opts
+}
+
+// SetClaimCheck sets default claim-check mode for all queues. See PriorityQueue.SetClaimCheck.
+func (opts *ClientOptions) SetClaimCheck(store BlobStore, minSize int, gc bool) *ClientOptions {
+	opts.blobStore = store
+	opts.claimMinSize = minSize
+	opts.blobGc = gc
+	return opts
+}
+
+// SetCircuitBreaker enables circuit breaker for the client. Nil settings disable it.
+func (opts *ClientOptions) SetCircuitBreaker(settings *BreakerSettings) *ClientOptions {
+	opts.breaker = settings
+	return opts
+}
+
+// SetBatchLimits sets default PushBatch chunking for all queues, zero disables a limit.
+// See PriorityQueue.SetBatchLimits.
+func (opts *ClientOptions) SetBatchLimits(maxCount, maxBytes int) *ClientOptions {
+	if maxCount < 0 || maxBytes < 0 {
+		panic("Value must be positive")
+	}
+	opts.batchMaxCount = maxCount
+	opts.batchMaxBytes = maxBytes
+	return opts
+}
+
+// NewFireMpqClient makes a first connection to the service to ensure service availability
+// and returns a client instance.
+func NewFireMpqClient(network, address string) (*FireMpqClient, error) {
+	return NewFireMpqClientWithOptions(network, address, nil)
+}
+
+// NewFireMpqClientWithOptions is the same as NewFireMpqClient, but allows to provide
+// client options. Nil options are the same as default options.
+func NewFireMpqClientWithOptions(network, address string, opts *ClientOptions) (*FireMpqClient, error) {
+	factory := func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+	if opts == nil {
+		opts = NewClientOptions()
+	}
+
+	fmc := &FireMpqClient{connFactory: factory, opts: opts}
+	if opts.breaker != nil {
+		fmc.breaker = newCircuitBreaker(address, opts.breaker)
+		fmc.queueBreakers = make(map[string]*CircuitBreaker)
+	}
+	if c, _, _, err := fmc.makeConn(); err != nil {
+		return nil, err
+	} else {
+		c.Write([]byte("QUIT\n"))
+		return fmc, nil
+	}
+}
+
+func (fmc *FireMpqClient) GetVersion() string {
+	fmc.statsLock.Lock()
+	defer fmc.statsLock.Unlock()
+	return fmc.version
+}
+
+func (fmc *FireMpqClient) makeConn() (net.Conn, *bufio.Writer, *TokenReader, error) {
+	return fmc.makeConnContext(context.Background())
+}
+
+func (fmc *FireMpqClient) makeConnContext(ctx context.Context) (net.Conn, *bufio.Writer, *TokenReader, error) {
+	if fmc.breaker != nil {
+		if err := fmc.breaker.Allow(); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	conn, bufWriter, tokReader, err := fmc.dial(ctx)
+	if fmc.breaker != nil {
+		fmc.breaker.Done(err)
+	}
+	if err != nil {
+		fmc.connFailures.Add(1)
+		fmc.setLastError(err)
+		fmc.opts.metrics.ConnectionFailed()
+		return nil, nil, nil, err
+	}
+	fmc.connsOpened.Add(1)
+	fmc.opts.metrics.ConnectionOpened()
+	return conn, bufWriter, tokReader, nil
+}
+
+func (fmc *FireMpqClient) setLastError(err error) {
+	fmc.statsLock.Lock()
+	fmc.lastErr = err
+	fmc.lastErrTime = time.Now()
+	fmc.statsLock.Unlock()
+}
+
+func (fmc *FireMpqClient) dial(ctx context.Context) (net.Conn, *bufio.Writer, *TokenReader, error) {
+	conn, err := fmc.connFactory(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	tokReader := NewTokenReader(conn)
+	connHdr, err := tokReader.ReadTokens()
+
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+
+	if len(connHdr) == 2 && connHdr[0] == "+HELLO" {
+		// TODO(vburenin): Add version check and log warning if version accidentally changes.
+		fmc.statsLock.Lock()
+		fmc.version = connHdr[1]
+		fmc.statsLock.Unlock()
+	} else {
+		conn.Close()
+		return nil, nil, nil, NewFireMpqError(-3, fmt.Sprintf("Unexpected hello string: %s", connHdr))
+	}
+	bufWriter := bufio.NewWriter(conn)
+	return conn, bufWriter, tokReader, nil
+}
+
+func (fmc *FireMpqClient) GetPQueue(queueName string) (*PriorityQueue, error) {
+	conn, bufWriter, tokReader, err := fmc.makeConn()
+	if err != nil {
+		return nil, err
+	}
+	pq, err := SetPQueueContext(queueName, bufWriter, tokReader)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	pq.conn = conn
+	fmc.setupQueue(pq)
+	return pq, nil
+}
+
+// setupQueue applies client options to a queue.
+func (fmc *FireMpqClient) setupQueue(pq *PriorityQueue) {
+	pq.metrics = fmc.opts.metrics
+	pq.tracer = fmc.opts.tracer
+	pq.SetCompression(fmc.opts.compressor, fmc.opts.compressMinSize)
+	pq.SetEncryption(fmc.opts.keyProvider)
+	pq.SetClaimCheck(fmc.opts.blobStore, fmc.opts.claimMinSize, fmc.opts.blobGc)
+	pq.breaker = fmc.queueBreaker(pq.queueName)
+	pq.SetBatchLimits(fmc.opts.batchMaxCount, fmc.opts.batchMaxBytes)
+}
+
+// CircuitBreaker returns client wide circuit breaker or nil if it is not enabled.
+func (fmc *FireMpqClient) CircuitBreaker() *CircuitBreaker {
+	return fmc.breaker
+}
+
+// queueBreaker returns a circuit breaker shared by all connections to the queue.
+func (fmc *FireMpqClient) queueBreaker(queueName string) *CircuitBreaker {
+	if fmc.breaker == nil || !fmc.opts.breaker.perQueue {
+		return fmc.breaker
+	}
+	fmc.breakersLock.Lock()
+	defer fmc.breakersLock.Unlock()
+	b, ok := fmc.queueBreakers[queueName]
+	if !ok {
+		b = newCircuitBreaker(queueName, fmc.opts.breaker)
+		fmc.queueBreakers[queueName] = b
+	}
+	return b
+}
+
+func (fmc *FireMpqClient) CreatePQueue(queueName string, opts *PqParams) (*PriorityQueue, error) {
+	conn, bufWriter, tokReader, err := fmc.makeConn()
+	if err != nil {
+		return nil, err
+	}
+	pq, err := CreatePQueue(queueName, bufWriter, tokReader, opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	pq.conn = conn
+	fmc.setupQueue(pq)
+	return pq, nil
+}
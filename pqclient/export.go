@@ -0,0 +1,323 @@
+package pqclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	. "github.com/vburenin/firempq_connector/fmpq_err"
+)
+
+// ExportRecord is a single message line of a JSONL export. Payloads which are not
+// valid UTF-8 are stored base64 encoded in PayloadBase64. Raw records contain payloads
+// exactly as they are stored in the queue, with headers and encodings inside the envelope.
+type ExportRecord struct {
+	Id            string            `json:"id"`
+	Payload       string            `json:"payload,omitempty"`
+	PayloadBase64 string            `json:"payload_base64,omitempty"`
+	ExpireTs      int64             `json:"expire_ts,omitempty"`
+	UnlockTs      int64             `json:"unlock_ts,omitempty"`
+	PopCount      int64             `json:"pop_count"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Raw           bool              `json:"raw,omitempty"`
+}
+
+// newExportRecord returns a raw record unless decode is set and the message has been decoded.
+func newExportRecord(qm *QueueMessage, decode bool) *ExportRecord {
+	rec := &ExportRecord{
+		Id:       qm.Id,
+		ExpireTs: qm.ExpireTs,
+		UnlockTs: qm.UnlockTs,
+		PopCount: qm.PopCount,
+	}
+	payload := qm.Payload
+	if decode && qm.Error == nil {
+		rec.Headers = qm.Headers
+	} else {
+		payload = qm.raw
+		rec.Raw = true
+	}
+	if utf8.ValidString(payload) {
+		rec.Payload = payload
+	} else {
+		rec.PayloadBase64 = base64.StdEncoding.EncodeToString([]byte(payload))
+	}
+	return rec
+}
+
+func (rec *ExportRecord) payload() (string, error) {
+	if rec.PayloadBase64 == "" {
+		return rec.Payload, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(rec.PayloadBase64)
+	return string(data), err
+}
+
+// ExportOptions configure Export.
+type ExportOptions struct {
+	destructive bool
+	batchSize   int64
+	lockTimeout int64
+	waitTimeout int64
+	decode      bool
+}
+
+// NewExportOptions returns non destructive export options reading messages in batches of 100
+// and keeping them locked for 10 minutes.
+func NewExportOptions() *ExportOptions {
+	return &ExportOptions{batchSize: 100, lockTimeout: 600000}
+}
+
+// SetDestructive makes export remove messages from the queue with POP instead of
+// locking and unlocking them.
+func (o *ExportOptions) SetDestructive(b bool) *ExportOptions {
+	o.destructive = b
+	return o
+}
+
+// SetDecode makes export write decoded payloads and headers instead of raw ones, so
+// payloads of encrypted queues are written in plain text. Messages which can't be decoded
+// are still exported raw.
+func (o *ExportOptions) SetDecode(b bool) *ExportOptions {
+	o.decode = b
+	return o
+}
+
+// SetBatchSize sets the max number of messages popped at once.
+func (o *ExportOptions) SetBatchSize(v int64) *ExportOptions {
+	if v < 1 {
+		panic("Value must be positive")
+	}
+	o.batchSize = v
+	return o
+}
+
+// SetLockTimeout sets time in milliseconds messages stay locked during non destructive export.
+// It must be longer than the whole export, otherwise messages may be exported twice.
+func (o *ExportOptions) SetLockTimeout(v int64) *ExportOptions {
+	if v < 1 {
+		panic("Value must be positive")
+	}
+	o.lockTimeout = v
+	return o
+}
+
+// SetWaitTimeout sets time in milliseconds to wait for new messages before considering
+// the queue exported.
+func (o *ExportOptions) SetWaitTimeout(v int64) *ExportOptions {
+	if v < 0 {
+		panic("Value must be positive")
+	}
+	o.waitTimeout = v
+	return o
+}
+
+// Export writes all available queue messages as JSON lines into w returning the number of
+// exported messages. Non destructive export locks every message and unlocks all of them once
+// the export is finished or failed. Locking increases message pop counts and messages that
+// are already locked by consumers are not exported. Payloads are exported raw unless
+// decoding is enabled, see ExportOptions.SetDecode.
+func Export(ctx context.Context, pq *PriorityQueue, w io.Writer, opts *ExportOptions) (int64, error) {
+	if opts == nil {
+		opts = NewExportOptions()
+	}
+	var receipts []string
+	if !opts.destructive {
+		defer func() {
+			for _, rcpt := range receipts {
+				pq.UnlockByReceipt(rcpt)
+			}
+		}()
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	popOpts := NewPopOptions().SetLimit(opts.batchSize).SetWaitTimeout(opts.waitTimeout).SetContext(ctx)
+	popLockOpts := NewPopLockOptions().
+		SetLimit(opts.batchSize).
+		SetWaitTimeout(opts.waitTimeout).
+		SetLockTimeout(opts.lockTimeout).
+		SetContext(ctx)
+	var count int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		var msgs []*QueueMessage
+		var err error
+		if opts.destructive {
+			msgs, err = pq.Pop(popOpts)
+		} else {
+			msgs, err = pq.PopLock(popLockOpts)
+		}
+		if err != nil {
+			return count, err
+		}
+		if len(msgs) == 0 {
+			return count, bw.Flush()
+		}
+		for _, qm := range msgs {
+			rec := newExportRecord(qm, opts.decode)
+			if qm.Receipt != "" {
+				// Unlock time is set by the export lock itself.
+				receipts = append(receipts, qm.Receipt)
+				rec.UnlockTs = 0
+			}
+			if err := enc.Encode(rec); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+}
+
+// ConflictMode defines what Import does with messages whose ids already exist in the queue.
+type ConflictMode int
+
+const (
+	// ConflictSkip leaves the existing message and skips the imported one.
+	ConflictSkip ConflictMode = iota
+	// ConflictFail stops import with ImportError.
+	ConflictFail
+	// ConflictNewId pushes the imported message with a server generated id.
+	ConflictNewId
+)
+
+// ImportError reports a record which couldn't be imported. Records are counted from 1.
+type ImportError struct {
+	Record int64
+	Id     string
+	Err    error
+}
+
+func (e *ImportError) Error() string {
+	return "Import of record " + strconv.FormatInt(e.Record, 10) + " failed: " + e.Err.Error()
+}
+
+func (e *ImportError) Unwrap() error {
+	return e.Err
+}
+
+// ImportResult contains Import counters.
+type ImportResult struct {
+	Imported int64
+	Skipped  int64
+	Expired  int64
+}
+
+// ImportOptions configure Import.
+type ImportOptions struct {
+	batchSize int64
+	conflict  ConflictMode
+}
+
+// NewImportOptions returns options pushing messages in batches of 100 skipping id conflicts.
+func NewImportOptions() *ImportOptions {
+	return &ImportOptions{batchSize: 100, conflict: ConflictSkip}
+}
+
+// SetBatchSize sets the max number of messages pushed at once.
+func (o *ImportOptions) SetBatchSize(v int64) *ImportOptions {
+	if v < 1 {
+		panic("Value must be positive")
+	}
+	o.batchSize = v
+	return o
+}
+
+// SetConflictMode sets id conflict handling.
+func (o *ImportOptions) SetConflictMode(m ConflictMode) *ImportOptions {
+	o.conflict = m
+	return o
+}
+
+// Import pushes messages read from JSON lines produced by Export. Remaining TTL is
+// calculated from the exported expiration time and already expired messages are skipped.
+// Pop counts and locks are not restored. Raw records are pushed as is, so the queue
+// consumers need the keys and claim check store of the exported queue to decode them.
+func Import(ctx context.Context, pq *PriorityQueue, r io.Reader, opts *ImportOptions) (*ImportResult, error) {
+	if opts == nil {
+		opts = NewImportOptions()
+	}
+	res := &ImportResult{}
+	dec := json.NewDecoder(bufio.NewReader(r))
+	var batch []*Message
+	var records []int64
+	var record int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		var rec ExportRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		record++
+		if err != nil {
+			return res, &ImportError{Record: record, Err: err}
+		}
+		payload, err := rec.payload()
+		if err != nil {
+			return res, &ImportError{Record: record, Id: rec.Id, Err: err}
+		}
+		msg := NewMessage(payload).SetId(rec.Id).SetHeaders(rec.Headers).SetContext(ctx)
+		msg.raw = rec.Raw
+		if rec.ExpireTs > 0 {
+			ttl := rec.ExpireTs - time.Now().UnixNano()/int64(time.Millisecond)
+			if ttl <= 0 {
+				res.Expired++
+				continue
+			}
+			msg.SetTtl(uint64(ttl))
+		}
+		batch = append(batch, msg)
+		records = append(records, record)
+		if int64(len(batch)) >= opts.batchSize {
+			if err := importBatch(pq, batch, records, opts.conflict, res); err != nil {
+				return res, err
+			}
+			batch, records = batch[:0], records[:0]
+		}
+	}
+	if len(batch) > 0 {
+		return res, importBatch(pq, batch, records, opts.conflict, res)
+	}
+	return res, nil
+}
+
+func importBatch(pq *PriorityQueue, batch []*Message, records []int64, conflict ConflictMode, res *ImportResult) error {
+	items, err := pq.PushBatch(batch...)
+	if err != nil {
+		return err
+	}
+	var retry []*Message
+	var retryRecords []int64
+	for i, msg := range batch {
+		if i >= len(items) {
+			return &ImportError{Record: records[i], Id: msg.id, Err: UnexpectedResponse(nil)}
+		}
+		err := items[i].Error
+		switch {
+		case err == nil:
+			res.Imported++
+		case !IsIdConflict(err) || conflict == ConflictFail:
+			return &ImportError{Record: records[i], Id: msg.id, Err: err}
+		case conflict == ConflictSkip:
+			res.Skipped++
+		default:
+			retry = append(retry, msg.SetId(""))
+			retryRecords = append(retryRecords, records[i])
+		}
+	}
+	if len(retry) > 0 {
+		return importBatch(pq, retry, retryRecords, ConflictFail, res)
+	}
+	return nil
+}
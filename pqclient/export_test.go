@@ -0,0 +1,127 @@
+package pqclient
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"maps"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/vburenin/firempq_connector/envelope"
+	. "github.com/vburenin/firempq_connector/parsers"
+)
+
+// popResponse returns +MSGS response with messages given as key value pairs.
+func popResponse(msgs ...[]string) string {
+	resp := "+MSGS *" + strconv.Itoa(len(msgs))
+	for _, fields := range msgs {
+		resp += " %" + strconv.Itoa(len(fields)/2)
+		for i := 0; i < len(fields); i += 2 {
+			resp += " " + fields[i] + " $" + strconv.Itoa(len(fields[i+1])) + " " + fields[i+1]
+		}
+	}
+	return resp + "\n"
+}
+
+// pushedBatch returns payloads of PUSHB command messages by their ids.
+func pushedBatch(t *testing.T, cmd string) map[string]string {
+	t.Helper()
+	tokens, err := NewTokenReader(readerConn{r: strings.NewReader(cmd)}).ReadTokens()
+	if err != nil || len(tokens) == 0 || tokens[0] != cmdPushBatch {
+		t.Fatalf("Unexpected batch command %q: %v", cmd, err)
+	}
+	payloads := make(map[string]string)
+	var id string
+	for i := 1; i+1 < len(tokens); i++ {
+		switch tokens[i] {
+		case "ID":
+			i++
+			id = tokens[i]
+		case "PL":
+			i++
+			payloads[id] = tokens[i]
+		}
+	}
+	return payloads
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	producer, out := testQueue("+OK\n")
+	producer.SetCompression(NewGzipCompressor(gzip.BestSpeed), 0)
+	compressed := strings.Repeat("compressible ", 100)
+	if err := producer.Push(NewMessage(compressed).SetHeader("h", "1")); err != nil {
+		t.Fatal(err)
+	}
+
+	expireTs := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	source := []struct {
+		id, payload string
+		want        *QueueMessage
+	}{
+		{"a", "plain", &QueueMessage{Payload: "plain"}},
+		{"b", Marshal(&Envelope{Headers: map[string]string{"k": "v"}, Body: "with headers"}),
+			&QueueMessage{Payload: "with headers", Headers: map[string]string{"k": "v"}}},
+		{"c", pushedPayload(t, out.String()), &QueueMessage{Payload: compressed, Headers: map[string]string{"h": "1"}}},
+		{"d", "\xff\xfe binary", &QueueMessage{Payload: "\xff\xfe binary"}},
+	}
+	var popped [][]string
+	var ids []string
+	for i, m := range source {
+		popped = append(popped, []string{"ID", m.id, "PL", m.payload, "RCPT", "r" + m.id, "ETS", expireTs, "POPCNT", "1"})
+		ids = append(ids, "+MSG "+source[i].id+"\n")
+	}
+	popped = append(popped, []string{"ID", "expired", "PL", "x", "RCPT", "rx", "ETS", "1"})
+	exported := popResponse(popped...) + "+MSGS *0\n" + strings.Repeat("+OK\n", len(popped))
+
+	for _, decode := range []bool{false, true} {
+		t.Run("decode "+strconv.FormatBool(decode), func(t *testing.T) {
+			exporter, exporterOut := testQueue(exported)
+			var buf bytes.Buffer
+			n, err := Export(context.Background(), exporter, &buf, NewExportOptions().SetDecode(decode))
+			if err != nil || n != int64(len(popped)) {
+				t.Fatalf("Exported %d messages: %v", n, err)
+			}
+			if !strings.HasSuffix(exporterOut.String(), "RUNLCK $2 rx\n") {
+				t.Fatalf("Exported messages aren't unlocked: %q", exporterOut.String())
+			}
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				var rec ExportRecord
+				if err := json.Unmarshal([]byte(line), &rec); err != nil {
+					t.Fatal(err)
+				}
+				if rec.Raw == decode || rec.Id == "d" && rec.PayloadBase64 == "" {
+					t.Fatalf("Unexpected record %s", line)
+				}
+			}
+
+			importer, importerOut := testQueue("+BATCH *" + strconv.Itoa(len(source)) + "\n" + strings.Join(ids, ""))
+			res, err := Import(context.Background(), importer, &buf, nil)
+			if err != nil || res.Imported != int64(len(source)) || res.Expired != 1 {
+				t.Fatalf("Unexpected import result %+v: %v", res, err)
+			}
+			pushed := pushedBatch(t, importerOut.String())
+			if !strings.Contains(importerOut.String(), " TTL ") {
+				t.Fatal("Expiration isn't imported")
+			}
+
+			for _, m := range source {
+				consumer, _ := testQueue(popResponse([]string{"ID", m.id, "PL", pushed[m.id]}))
+				msgs, err := consumer.Pop(NewPopOptions())
+				if err != nil || len(msgs) != 1 || msgs[0].Error != nil {
+					t.Fatalf("Message %s: unexpected pop result %+v: %v", m.id, msgs, err)
+				}
+				if msgs[0].Payload != m.want.Payload || !maps.Equal(msgs[0].Headers, m.want.Headers) {
+					t.Fatalf("Message %s: got %q %v, want %q %v",
+						m.id, msgs[0].Payload, msgs[0].Headers, m.want.Payload, m.want.Headers)
+				}
+				if !decode && pushed[m.id] != m.payload {
+					t.Fatalf("Message %s: raw payload %q is changed into %q", m.id, m.payload, pushed[m.id])
+				}
+			}
+		})
+	}
+}
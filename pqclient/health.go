@@ -0,0 +1,117 @@
+package pqclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	. "github.com/vburenin/firempq_connector/fmpq_err"
+	. "github.com/vburenin/firempq_connector/netutils"
+)
+
+var cmdPing = "PING"
+
+// Ping opens a new connection to the service and measures PING round trip time.
+// The connection is closed afterwards. ctx deadline and cancellation are respected.
+func (fmc *FireMpqClient) Ping(ctx context.Context) (time.Duration, error) {
+	rtt, err := fmc.ping(ctx)
+	if err != nil {
+		fmc.setLastError(err)
+	}
+	return rtt, err
+}
+
+func (fmc *FireMpqClient) ping(ctx context.Context) (time.Duration, error) {
+	conn, bufWriter, tokReader, err := fmc.makeConnContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	start := time.Now()
+	if err := SendCommand(bufWriter, cmdPing); err != nil {
+		return 0, pingError(ctx, err)
+	}
+	tokens, err := tokReader.ReadTokens()
+	if err != nil {
+		return 0, pingError(ctx, err)
+	}
+	rtt := time.Since(start)
+	if len(tokens) == 0 || tokens[0] != "+PONG" {
+		return 0, UnexpectedResponse(tokens)
+	}
+	bufWriter.WriteString("QUIT\n")
+	bufWriter.Flush()
+	return rtt, nil
+}
+
+// pingError prefers context error over I/O error caused by closing the connection on cancellation.
+func pingError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// HealthStatus is a client health report returned by HealthHandler.
+type HealthStatus struct {
+	Healthy            bool    `json:"healthy"`
+	ServerVersion      string  `json:"server_version"`
+	PingMs             float64 `json:"ping_ms"`
+	Error              string  `json:"error,omitempty"`
+	ConnectionsOpened  int64   `json:"connections_opened"`
+	ConnectionFailures int64   `json:"connection_failures"`
+	CircuitState       string  `json:"circuit_state,omitempty"`
+	LastError          string  `json:"last_error,omitempty"`
+	LastErrorTime      string  `json:"last_error_time,omitempty"`
+}
+
+// Health pings the service and returns client health report.
+func (fmc *FireMpqClient) Health(ctx context.Context) *HealthStatus {
+	rtt, err := fmc.Ping(ctx)
+	st := &HealthStatus{
+		Healthy:            err == nil,
+		PingMs:             float64(rtt) / float64(time.Millisecond),
+		ConnectionsOpened:  fmc.connsOpened.Load(),
+		ConnectionFailures: fmc.connFailures.Load(),
+	}
+	if err != nil {
+		st.Error = err.Error()
+	}
+	if fmc.breaker != nil {
+		st.CircuitState = fmc.breaker.State().String()
+	}
+	fmc.statsLock.Lock()
+	st.ServerVersion = fmc.version
+	if fmc.lastErr != nil {
+		st.LastError = fmc.lastErr.Error()
+		st.LastErrorTime = fmc.lastErrTime.UTC().Format(time.RFC3339)
+	}
+	fmc.statsLock.Unlock()
+	return st
+}
+
+// HealthHandler returns an HTTP handler reporting client health as JSON for liveness and
+// readiness probes. It responds with 200 if the service answers PING within timeout
+// and with 503 otherwise.
+func (fmc *FireMpqClient) HealthHandler(timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		st := fmc.Health(ctx)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if st.Healthy {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(st)
+	})
+}
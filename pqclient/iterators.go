@@ -0,0 +1,103 @@
+package pqclient
+
+import (
+	"context"
+	"iter"
+)
+
+// defaultIterWait is a long polling wait timeout in milliseconds used by Messages and All
+// if pop options don't set one.
+const defaultIterWait = 1000
+
+// All returns an iterator over messages popped from the queue. It long polls the queue
+// until ctx is done or pop fails; in the latter case the error is yielded as the last value.
+// Cancellation is noticed after the current long polling call completes.
+//
+// Messages are popped locked with the queue lock timeout and each one is deleted once the loop
+// body is done with it, so a message is redelivered if the process dies while handling it.
+// Messages of the popped batch which are not iterated over because the loop stops early or ctx
+// is done are unlocked and stay in the queue. Loop body must not use the queue.
+//
+//	for msg, err := range pq.All(ctx, NewPopOptions().SetLimit(10)) {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+func (pq *PriorityQueue) All(ctx context.Context, opts *PopOptions) iter.Seq2[*QueueMessage, error] {
+	return func(yield func(*QueueMessage, error) bool) {
+		pq.each(ctx, opts, func(msg *QueueMessage, err error) (bool, bool) {
+			return true, yield(msg, err)
+		})
+	}
+}
+
+// Messages returns a channel of messages popped from the queue the same way as All does.
+// The channel is closed once ctx is done or pop fails. Pop failure is delivered as the last
+// message with only its Error set. A message is deleted from the queue as soon as it is
+// received from the channel, messages which are popped but not received are unlocked.
+// Queue must not be used by any other goroutine until the channel is closed.
+func (pq *PriorityQueue) Messages(ctx context.Context, opts *PopOptions) <-chan *QueueMessage {
+	ch := make(chan *QueueMessage)
+	go func() {
+		defer close(ch)
+		pq.each(ctx, opts, func(msg *QueueMessage, err error) (bool, bool) {
+			if err != nil {
+				msg = &QueueMessage{Error: err}
+			}
+			select {
+			case ch <- msg:
+				return true, true
+			case <-ctx.Done():
+				return false, false
+			}
+		})
+	}()
+	return ch
+}
+
+// each pops locked messages passing them to deliver until it returns false as its second value.
+// Delivered messages are deleted, the rest of the batch is unlocked.
+func (pq *PriorityQueue) each(ctx context.Context, opts *PopOptions,
+	deliver func(*QueueMessage, error) (delivered, more bool)) {
+	o := NewPopLockOptions().SetWaitTimeout(defaultIterWait).SetContext(ctx)
+	if opts != nil {
+		o.limit = opts.limit
+		if opts.waitTimeout > 0 {
+			o.waitTimeout = opts.waitTimeout
+		}
+	}
+
+	for ctx.Err() == nil {
+		msgs, err := pq.PopLock(o)
+		if err != nil {
+			if ctx.Err() == nil {
+				deliver(nil, err)
+			}
+			return
+		}
+		for i, msg := range msgs {
+			rcpt := msg.Receipt
+			// Message is acknowledged by the iterator, not by its consumer.
+			msg.Receipt = ""
+			delivered, more := false, false
+			if ctx.Err() == nil {
+				delivered, more = deliver(msg, nil)
+			}
+			if !delivered {
+				pq.UnlockByReceipt(rcpt)
+			} else if err := pq.DeleteByReceipt(rcpt); err != nil && !isRejected(err) {
+				// Expired lock only means the message is redelivered, anything else is fatal.
+				unlockAll(pq, msgs[i+1:])
+				if more {
+					deliver(nil, err)
+				}
+				return
+			}
+			if !more {
+				unlockAll(pq, msgs[i+1:])
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package pqclient
+
+import (
+	"context"
+
+	. "github.com/vburenin/firempq_connector/ratelimit"
+)
+
+// SetPushLimits attaches rate limiters to Push and PushBatch calls. msgLimiter is charged
+// one token per message and byteLimiter one token per payload byte. Either of them can be nil.
+// Limiters wait respecting message context, see Message.SetContext.
+func (pq *PriorityQueue) SetPushLimits(msgLimiter, byteLimiter *Limiter) *PriorityQueue {
+	pq.pushMsgLimiter = msgLimiter
+	pq.pushByteLimiter = byteLimiter
+	return pq
+}
+
+// SetPopLimiter attaches a rate limiter to Pop and PopLock calls. Each call takes as many tokens
+// as many messages it may return and gives back tokens for messages it didn't receive.
+// Limiter waits respecting pop options context.
+func (pq *PriorityQueue) SetPopLimiter(l *Limiter) *PriorityQueue {
+	pq.popLimiter = l
+	return pq
+}
+
+// Default PushBatch chunk limits of queues opened by a client, see SetBatchLimits.
+const (
+	DefaultBatchMaxCount = 100
+	DefaultBatchMaxBytes = 1024 * 1024
+)
+
+// SetBatchLimits makes PushBatch split batches into chunks of at most maxCount messages
+// and maxBytes of encoded data. Zero disables a limit. Queues opened by a client use
+// DefaultBatchMaxCount and DefaultBatchMaxBytes unless client options say otherwise.
+// The service doesn't report its limits, so they aren't learned and have to match its config.
+// Chunks are sent pipelined and their results are merged in the original order.
+// A chunk rejected by the service as a whole fails only its own messages.
+// A message larger than maxBytes is sent in a chunk of its own.
+func (pq *PriorityQueue) SetBatchLimits(maxCount, maxBytes int) *PriorityQueue {
+	if maxCount < 0 || maxBytes < 0 {
+		panic("Value must be positive")
+	}
+	pq.batchMaxCount = maxCount
+	pq.batchMaxBytes = maxBytes
+	return pq
+}
+
+func (pq *PriorityQueue) waitPushLimits(ctx context.Context, msgs ...*Message) error {
+	if pq.pushMsgLimiter != nil {
+		if err := pq.pushMsgLimiter.Wait(ctx, len(msgs)); err != nil {
+			return err
+		}
+	}
+	if pq.pushByteLimiter != nil {
+		size := 0
+		for _, msg := range msgs {
+			size += len(msg.payload)
+		}
+		if err := pq.pushByteLimiter.Wait(ctx, size); err != nil {
+			if pq.pushMsgLimiter != nil {
+				pq.pushMsgLimiter.Return(len(msgs))
+			}
+			return err
+		}
+	}
+	return nil
+}
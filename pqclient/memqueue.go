@@ -0,0 +1,431 @@
+package pqclient
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/vburenin/firempq_connector/fmpq_err"
+)
+
+// memWaitPoll is a period in milliseconds waiting pops recheck the queue, since
+// delayed messages and locks may expire while they wait.
+const memWaitPoll = 10
+
+var (
+	errMemNotFound   = NewFireMpqError(404, "Message not found")
+	errMemLocked     = NewFireMpqError(400, "Message is locked")
+	errMemNotLocked  = NewFireMpqError(400, "Message is not locked")
+	errMemIdConflict = NewFireMpqError(409, "Message with the same id already exists")
+	errMemQueueFull  = NewFireMpqError(413, "Queue is full")
+)
+
+// Clock returns the current time for MemoryQueue.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// ManualClock is a clock which only moves when tests tell it to.
+type ManualClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+// NewManualClock returns a clock set to the given time.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	c.now = c.now.Add(d)
+	c.lock.Unlock()
+}
+
+// Set sets the clock time.
+func (c *ManualClock) Set(now time.Time) {
+	c.lock.Lock()
+	c.now = now
+	c.lock.Unlock()
+}
+
+type memMessage struct {
+	id       string
+	payload  string
+	headers  map[string]string
+	priority int64
+	seq      int64
+	expireAt time.Time
+	unlockAt time.Time
+	popCount int64
+	receipt  string
+}
+
+// MemoryQueue is an in-memory Queue for application tests. It simulates message priorities
+// (lower values are popped first, FIFO within a priority), delays, TTLs, locks with receipts,
+// pop limits and max queue size. Time is taken from a Clock, see SetClock. Waiting pops wait in real time. Errors are FireMpqError values similar
+// to the ones returned by the service.
+type MemoryQueue struct {
+	name  string
+	clock Clock
+
+	lock        sync.Mutex
+	msgTtl      int64
+	maxSize     int64
+	delay       int64
+	popLimit    int64
+	lockTimeout int64
+	msgs        map[string]*memMessage
+	receipts    map[string]*memMessage
+	seq         int64
+	wake        chan struct{}
+}
+
+// NewMemoryQueue returns an empty in-memory queue. Messages don't expire, locks time out
+// after 60 seconds and queue size is unlimited unless params say otherwise.
+func NewMemoryQueue(name string, params *PqParams) *MemoryQueue {
+	q := &MemoryQueue{
+		name:        name,
+		clock:       systemClock{},
+		lockTimeout: 60000,
+		msgs:        make(map[string]*memMessage),
+		receipts:    make(map[string]*memMessage),
+		wake:        make(chan struct{}),
+	}
+	q.SetParams(params)
+	return q
+}
+
+// SetClock sets a clock used to handle delays, TTLs and locks.
+func (q *MemoryQueue) SetClock(c Clock) *MemoryQueue {
+	q.lock.Lock()
+	q.clock = c
+	q.lock.Unlock()
+	return q
+}
+
+func (q *MemoryQueue) GetName() string {
+	return q.name
+}
+
+// Len returns the number of messages in the queue including delayed and locked ones.
+func (q *MemoryQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.expire(q.clock.Now())
+	return len(q.msgs)
+}
+
+func (q *MemoryQueue) SetParams(params *PqParams) error {
+	if params == nil {
+		return nil
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if params.msgTtl > 0 {
+		q.msgTtl = params.msgTtl
+	}
+	if params.maxSize > 0 {
+		q.maxSize = params.maxSize
+	}
+	if params.delay >= 0 {
+		q.delay = params.delay
+	}
+	if params.popLimit >= 0 {
+		q.popLimit = params.popLimit
+	}
+	if params.lockTimeout >= 0 {
+		q.lockTimeout = params.lockTimeout
+	}
+	return nil
+}
+
+func (q *MemoryQueue) Push(msg *Message) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	err := q.push(msg, q.clock.Now())
+	if err == nil {
+		q.notify()
+	}
+	return err
+}
+
+func (q *MemoryQueue) PushBatch(msgs ...*Message) ([]PushBatchItem, error) {
+	if len(msgs) == 0 {
+		return nil, nil
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	now := q.clock.Now()
+	items := make([]PushBatchItem, len(msgs))
+	for i, msg := range msgs {
+		items[i].Error = q.push(msg, now)
+		if items[i].Error == nil {
+			items[i].MsgID = q.lastId(msg)
+		}
+	}
+	q.notify()
+	return items, nil
+}
+
+func (q *MemoryQueue) push(msg *Message, now time.Time) error {
+	q.expire(now)
+	if msg.id != "" && q.msgs[msg.id] != nil {
+		return errMemIdConflict
+	}
+	if q.maxSize > 0 && int64(len(q.msgs)) >= q.maxSize {
+		return errMemQueueFull
+	}
+	q.seq++
+	m := &memMessage{
+		id:       msg.id,
+		payload:  msg.payload,
+		headers:  copyHeaders(msg.headers),
+		priority: msg.priority,
+		seq:      q.seq,
+	}
+	if m.id == "" {
+		m.id = "mem-" + strconv.FormatInt(q.seq, 10)
+	}
+	delay, ttl := msg.delay, msg.ttl
+	if delay < 0 {
+		delay = q.delay
+	}
+	if ttl < 0 {
+		ttl = q.msgTtl
+	}
+	if delay > 0 {
+		m.unlockAt = now.Add(time.Duration(delay) * time.Millisecond)
+	}
+	if ttl > 0 {
+		m.expireAt = now.Add(time.Duration(ttl) * time.Millisecond)
+	}
+	q.msgs[m.id] = m
+	return nil
+}
+
+// lastId returns id of just pushed message.
+func (q *MemoryQueue) lastId(msg *Message) string {
+	if msg.id != "" {
+		return msg.id
+	}
+	return "mem-" + strconv.FormatInt(q.seq, 10)
+}
+
+func (q *MemoryQueue) Pop(opts *PopOptions) ([]*QueueMessage, error) {
+	var wait int64
+	if opts != nil {
+		wait = opts.waitTimeout
+	}
+	return q.waitPop(opts.context(), opts.expectedCount(), wait, -1)
+}
+
+func (q *MemoryQueue) PopLock(opts *PopLockOptions) ([]*QueueMessage, error) {
+	var wait int64
+	lockTimeout := int64(-1)
+	if opts != nil {
+		wait = opts.waitTimeout
+		lockTimeout = opts.lockTimeout
+	}
+	q.lock.Lock()
+	if lockTimeout < 0 {
+		lockTimeout = q.lockTimeout
+	}
+	q.lock.Unlock()
+	return q.waitPop(opts.context(), opts.expectedCount(), wait, lockTimeout)
+}
+
+// waitPop pops up to limit messages waiting for them up to wait milliseconds.
+// Negative lock timeout means messages are removed from the queue.
+func (q *MemoryQueue) waitPop(ctx context.Context, limit int, wait, lockTimeout int64) ([]*QueueMessage, error) {
+	deadline := time.Now().Add(time.Duration(wait) * time.Millisecond)
+	for {
+		q.lock.Lock()
+		msgs := q.pop(limit, lockTimeout)
+		wake := q.wake
+		q.lock.Unlock()
+
+		left := time.Until(deadline)
+		if len(msgs) > 0 || left <= 0 {
+			return msgs, nil
+		}
+		if left > memWaitPoll*time.Millisecond {
+			left = memWaitPoll * time.Millisecond
+		}
+		t := time.NewTimer(left)
+		select {
+		case <-wake:
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+		t.Stop()
+	}
+}
+
+func (q *MemoryQueue) pop(limit int, lockTimeout int64) []*QueueMessage {
+	now := q.clock.Now()
+	q.expire(now)
+	var avail []*memMessage
+	for _, m := range q.msgs {
+		if m.receipt == "" && !m.unlockAt.After(now) {
+			avail = append(avail, m)
+		}
+	}
+	sort.Slice(avail, func(i, j int) bool {
+		if avail[i].priority != avail[j].priority {
+			return avail[i].priority < avail[j].priority
+		}
+		return avail[i].seq < avail[j].seq
+	})
+	if len(avail) > limit {
+		avail = avail[:limit]
+	}
+
+	msgs := make([]*QueueMessage, 0, len(avail))
+	for _, m := range avail {
+		m.popCount++
+		if lockTimeout < 0 {
+			delete(q.msgs, m.id)
+		} else {
+			q.seq++
+			m.receipt = "mem-rcpt-" + strconv.FormatInt(q.seq, 10)
+			m.unlockAt = now.Add(time.Duration(lockTimeout) * time.Millisecond)
+			q.receipts[m.receipt] = m
+		}
+		msgs = append(msgs, m.queueMessage())
+	}
+	return msgs
+}
+
+// expire removes expired messages and releases expired locks.
+func (q *MemoryQueue) expire(now time.Time) {
+	for _, m := range q.msgs {
+		if !m.expireAt.IsZero() && !m.expireAt.After(now) {
+			q.remove(m)
+			continue
+		}
+		if m.receipt != "" && !m.unlockAt.After(now) {
+			q.unlock(m)
+		}
+	}
+}
+
+// unlock releases message lock removing the message if it has reached the pop limit.
+func (q *MemoryQueue) unlock(m *memMessage) {
+	delete(q.receipts, m.receipt)
+	m.receipt = ""
+	m.unlockAt = time.Time{}
+	if q.popLimit > 0 && m.popCount >= q.popLimit {
+		delete(q.msgs, m.id)
+	}
+}
+
+func (q *MemoryQueue) remove(m *memMessage) {
+	if m.receipt != "" {
+		delete(q.receipts, m.receipt)
+	}
+	delete(q.msgs, m.id)
+}
+
+func (q *MemoryQueue) DeleteById(id string) error {
+	return q.byId(id, false, func(m *memMessage) { q.remove(m) })
+}
+
+func (q *MemoryQueue) DeleteLockedById(id string) error {
+	return q.byId(id, true, func(m *memMessage) { q.remove(m) })
+}
+
+func (q *MemoryQueue) UnlockById(id string) error {
+	return q.byId(id, true, func(m *memMessage) { q.unlock(m) })
+}
+
+func (q *MemoryQueue) DeleteByReceipt(rcpt string) error {
+	return q.byReceipt(rcpt, func(m *memMessage) { q.remove(m) })
+}
+
+func (q *MemoryQueue) UnlockByReceipt(rcpt string) error {
+	return q.byReceipt(rcpt, func(m *memMessage) { q.unlock(m) })
+}
+
+func (q *MemoryQueue) byId(id string, locked bool, f func(*memMessage)) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.expire(q.clock.Now())
+	m := q.msgs[id]
+	if m == nil {
+		return errMemNotFound
+	}
+	if locked && m.receipt == "" {
+		return errMemNotLocked
+	}
+	if !locked && m.receipt != "" {
+		return errMemLocked
+	}
+	f(m)
+	q.notify()
+	return nil
+}
+
+func (q *MemoryQueue) byReceipt(rcpt string, f func(*memMessage)) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.expire(q.clock.Now())
+	m := q.receipts[rcpt]
+	if m == nil {
+		return errMemNotFound
+	}
+	f(m)
+	q.notify()
+	return nil
+}
+
+// notify wakes up waiting pops.
+func (q *MemoryQueue) notify() {
+	close(q.wake)
+	q.wake = make(chan struct{})
+}
+
+func (m *memMessage) queueMessage() *QueueMessage {
+	qm := &QueueMessage{
+		Id:       m.id,
+		Payload:  m.payload,
+		Receipt:  m.receipt,
+		PopCount: m.popCount,
+		Headers:  copyHeaders(m.headers),
+	}
+	if !m.expireAt.IsZero() {
+		qm.ExpireTs = m.expireAt.UnixNano() / int64(time.Millisecond)
+	}
+	if m.receipt != "" {
+		qm.UnlockTs = m.unlockAt.UnixNano() / int64(time.Millisecond)
+	}
+	return qm
+}
+
+func copyHeaders(headers map[string]string) map[string]string {
+	if len(headers) == 0 {
+		return nil
+	}
+	c := make(map[string]string, len(headers))
+	for k, v := range headers {
+		c[k] = v
+	}
+	return c
+}
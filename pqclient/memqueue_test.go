@@ -0,0 +1,173 @@
+package pqclient
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/vburenin/firempq_connector/fmpq_err"
+)
+
+func newTestMemQueue(params *PqParams) (*MemoryQueue, *ManualClock) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	return NewMemoryQueue("test", params).SetClock(clock), clock
+}
+
+func popIds(t *testing.T, msgs []*QueueMessage, err error) []string {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.Id
+	}
+	return ids
+}
+
+func expectIds(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("Got messages %q, want %q", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("Got messages %q, want %q", got, want)
+		}
+	}
+}
+
+func TestMemoryQueuePopsByPriority(t *testing.T) {
+	q, _ := newTestMemQueue(nil)
+	q.Push(NewMessage("1").SetId("a").SetPriority(10))
+	q.Push(NewMessage("2").SetId("b").SetPriority(1))
+	items, err := q.PushBatch(NewMessage("3").SetId("c"), NewMessage("4"))
+	if err != nil || len(items) != 2 || items[0].MsgID != "c" || items[1].MsgID == "" {
+		t.Fatalf("Unexpected batch result: %v, %v", items, err)
+	}
+
+	msgs, err := q.Pop(NewPopOptions().SetLimit(3))
+	expectIds(t, popIds(t, msgs, err), "c", items[1].MsgID, "b")
+	if msgs[0].Payload != "3" {
+		t.Fatalf("Got payload %q", msgs[0].Payload)
+	}
+	msgs, err = q.Pop(NewPopOptions().SetLimit(3))
+	expectIds(t, popIds(t, msgs, err), "a")
+	if q.Len() != 0 {
+		t.Fatalf("Queue has %d messages after pop", q.Len())
+	}
+}
+
+func TestMemoryQueueDelayAndTtl(t *testing.T) {
+	q, clock := newTestMemQueue(NewPQueueOptions().SetMsgTtl(5000))
+	q.Push(NewMessage("").SetId("delayed").SetDelay(1000))
+	q.Push(NewMessage("").SetId("short").SetTtl(500))
+	q.Push(NewMessage("").SetId("default"))
+
+	clock.Advance(500 * time.Millisecond)
+	if q.Len() != 2 {
+		t.Fatalf("Expired message is still in the queue, len %d", q.Len())
+	}
+	msgs, err := q.PopLock(NewPopLockOptions().SetLimit(10))
+	expectIds(t, popIds(t, msgs, err), "default")
+
+	clock.Advance(500 * time.Millisecond)
+	msgs, err = q.PopLock(NewPopLockOptions().SetLimit(10))
+	expectIds(t, popIds(t, msgs, err), "delayed")
+
+	clock.Advance(5 * time.Second)
+	if q.Len() != 0 {
+		t.Fatalf("Messages haven't expired, len %d", q.Len())
+	}
+}
+
+func TestMemoryQueueLocks(t *testing.T) {
+	q, clock := newTestMemQueue(NewPQueueOptions().SetLockTimeout(1000))
+	q.Push(NewMessage("").SetId("a"))
+	q.Push(NewMessage("").SetId("b"))
+
+	msgs, err := q.PopLock(NewPopLockOptions().SetLimit(2))
+	expectIds(t, popIds(t, msgs, err), "a", "b")
+	if msgs[0].Receipt == "" || msgs[0].UnlockTs != clock.Now().Add(time.Second).UnixNano()/int64(time.Millisecond) {
+		t.Fatalf("Unexpected lock: %+v", msgs[0])
+	}
+	msgs2, err := q.PopLock(nil)
+	expectIds(t, popIds(t, msgs2, err))
+
+	if err := q.DeleteById("a"); err == nil || IsIdConflict(err) {
+		t.Fatalf("Locked message deleted by id: %v", err)
+	}
+	if err := q.DeleteByReceipt(msgs[0].Receipt); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.DeleteByReceipt(msgs[0].Receipt); err == nil {
+		t.Fatal("Message deleted twice")
+	}
+	if err := q.UnlockByReceipt(msgs[1].Receipt); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.UnlockById("b"); err == nil || IsIdConflict(err) {
+		t.Fatalf("Unlocked message unlocked again: %v", err)
+	}
+
+	msgs, err = q.PopLock(NewPopLockOptions().SetLockTimeout(100))
+	expectIds(t, popIds(t, msgs, err), "b")
+	clock.Advance(100 * time.Millisecond)
+	if err := q.DeleteByReceipt(msgs[0].Receipt); err == nil {
+		t.Fatal("Message deleted with expired receipt")
+	}
+	msgs, err = q.PopLock(nil)
+	expectIds(t, popIds(t, msgs, err), "b")
+	if msgs[0].PopCount != 3 {
+		t.Fatalf("Got pop count %d, want 3", msgs[0].PopCount)
+	}
+	if err := q.DeleteLockedById("b"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryQueuePopLimit(t *testing.T) {
+	q, clock := newTestMemQueue(NewPQueueOptions().SetPopLimit(2).SetLockTimeout(10))
+	q.Push(NewMessage("").SetId("a"))
+	for i := 0; i < 2; i++ {
+		msgs, err := q.PopLock(nil)
+		expectIds(t, popIds(t, msgs, err), "a")
+		clock.Advance(10 * time.Millisecond)
+	}
+	if q.Len() != 0 {
+		t.Fatal("Message is kept after reaching pop limit")
+	}
+}
+
+func TestMemoryQueueMaxSizeAndIdConflict(t *testing.T) {
+	q, _ := newTestMemQueue(NewPQueueOptions().SetMaxSize(2))
+	if err := q.Push(NewMessage("").SetId("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Push(NewMessage("").SetId("a")); !IsIdConflict(err) {
+		t.Fatalf("Got %v, want id conflict", err)
+	}
+	items, err := q.PushBatch(NewMessage(""), NewMessage(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items[0].Error != nil || !IsQueueFull(items[1].Error) {
+		t.Fatalf("Got %v, want the second message rejected as queue full", items)
+	}
+}
+
+func TestMemoryQueueWaitingPop(t *testing.T) {
+	q, _ := newTestMemQueue(nil)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		q.Push(NewMessage("").SetId("a"))
+	}()
+	msgs, err := q.Pop(NewPopOptions().SetWaitTimeout(5000))
+	expectIds(t, popIds(t, msgs, err), "a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err := q.Pop(NewPopOptions().SetWaitTimeout(5000).SetContext(ctx)); err != context.Canceled {
+		t.Fatalf("Got %v, want context.Canceled", err)
+	}
+}
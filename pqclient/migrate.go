@@ -0,0 +1,246 @@
+package pqclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/vburenin/firempq_connector/fmpq_err"
+)
+
+var ErrCheckpointMismatch = errors.New("Checkpoint belongs to a different migration")
+
+// MigrateOptions configure Migrate.
+type MigrateOptions struct {
+	batchSize   int64
+	lockTimeout int64
+	waitTimeout int64
+	checkpoint  string
+	progress    func(*MigrateProgress)
+	decode      bool
+}
+
+// NewMigrateOptions returns options moving messages in batches of 100 locked for 60 seconds.
+// Migration stops as soon as the source queue returns no messages.
+func NewMigrateOptions() *MigrateOptions {
+	return &MigrateOptions{batchSize: 100, lockTimeout: 60000}
+}
+
+// SetBatchSize sets the max number of messages popped and pushed at once.
+func (o *MigrateOptions) SetBatchSize(v int64) *MigrateOptions {
+	if v < 1 {
+		panic("Value must be positive")
+	}
+	o.batchSize = v
+	return o
+}
+
+// SetLockTimeout sets time in milliseconds source messages stay locked while they are pushed.
+func (o *MigrateOptions) SetLockTimeout(v int64) *MigrateOptions {
+	if v < 1 {
+		panic("Value must be positive")
+	}
+	o.lockTimeout = v
+	return o
+}
+
+// SetWaitTimeout sets time in milliseconds to wait for new messages before considering
+// the source queue drained.
+func (o *MigrateOptions) SetWaitTimeout(v int64) *MigrateOptions {
+	if v < 0 {
+		panic("Value must be positive")
+	}
+	o.waitTimeout = v
+	return o
+}
+
+// SetDecode makes Migrate decode source payloads and push them encoded with dst settings,
+// e.g. to compress or encrypt messages with a different key. Messages which can't be decoded
+// stay locked in src and are counted as failed. By default payloads are moved exactly as
+// they are stored, so dst consumers need the same decryption keys and claim check store.
+func (o *MigrateOptions) SetDecode(b bool) *MigrateOptions {
+	o.decode = b
+	return o
+}
+
+// SetCheckpointFile sets a file progress is saved to after every batch. Existing
+// checkpoint of the same migration is loaded so counters continue where they stopped.
+func (o *MigrateOptions) SetCheckpointFile(path string) *MigrateOptions {
+	o.checkpoint = path
+	return o
+}
+
+// SetProgressCallback sets a function called after every batch.
+func (o *MigrateOptions) SetProgressCallback(f func(*MigrateProgress)) *MigrateOptions {
+	o.progress = f
+	return o
+}
+
+// MigrateProgress is a migration state saved into checkpoint files.
+type MigrateProgress struct {
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Moved       int64     `json:"moved"`
+	Expired     int64     `json:"expired"`
+	Failed      int64     `json:"failed"`
+	Started     time.Time `json:"started"`
+	Updated     time.Time `json:"updated"`
+	Done        bool      `json:"done"`
+}
+
+// Migrate moves messages from src to dst until src is drained or ctx is done.
+// Messages are popped with a lock and pushed keeping their ids, headers and remaining TTL,
+// source messages are deleted only after dst has accepted them. Messages already present
+// in dst with the same id are considered moved, so an interrupted migration can be restarted
+// safely. Messages dst refused stay locked in src and become available again after the
+// lock timeout. Message priority is not returned by the service, so it isn't preserved.
+// Payloads are moved without decoding unless decoding is enabled, see MigrateOptions.SetDecode.
+func Migrate(ctx context.Context, src, dst *PriorityQueue, opts *MigrateOptions) (*MigrateProgress, error) {
+	if opts == nil {
+		opts = NewMigrateOptions()
+	}
+	now := time.Now()
+	progress := &MigrateProgress{Source: src.GetName(), Destination: dst.GetName(), Started: now, Updated: now}
+	if opts.checkpoint != "" {
+		if err := loadCheckpoint(opts.checkpoint, progress); err != nil {
+			return nil, err
+		}
+		progress.Done = false
+	}
+
+	popOpts := NewPopLockOptions().
+		SetLimit(opts.batchSize).
+		SetLockTimeout(opts.lockTimeout).
+		SetWaitTimeout(opts.waitTimeout).
+		SetContext(ctx)
+	// Raw payloads are pushed as is, decoding them would only fetch claim check blobs.
+	popOpts.raw = !opts.decode
+	for ctx.Err() == nil {
+		msgs, err := src.PopLock(popOpts)
+		if err != nil {
+			return progress, err
+		}
+		if len(msgs) == 0 {
+			progress.Done = true
+		} else if err := migrateBatch(ctx, src, dst, msgs, opts.decode, progress); err != nil {
+			return progress, err
+		}
+		progress.Updated = time.Now()
+		if opts.checkpoint != "" {
+			if err := saveCheckpoint(opts.checkpoint, progress); err != nil {
+				return progress, err
+			}
+		}
+		if opts.progress != nil {
+			opts.progress(progress)
+		}
+		if progress.Done {
+			return progress, nil
+		}
+	}
+	return progress, ctx.Err()
+}
+
+func migrateBatch(ctx context.Context, src, dst *PriorityQueue, msgs []*QueueMessage, decode bool,
+	progress *MigrateProgress) error {
+	nowMs := time.Now().UnixNano() / int64(time.Millisecond)
+	pending := make([]*QueueMessage, 0, len(msgs))
+	push := make([]*Message, 0, len(msgs))
+	for _, qm := range msgs {
+		ttl := qm.ExpireTs - nowMs
+		if qm.ExpireTs > 0 && ttl <= 0 {
+			if err := src.DeleteByReceipt(qm.Receipt); err != nil {
+				return err
+			}
+			if !decode && src.blobGc {
+				// Blobs of raw messages aren't fetched, so DeleteByReceipt doesn't know them.
+				payload := qm.raw
+				src.dropPayload(&payload)
+			}
+			progress.Expired++
+			continue
+		}
+		var msg *Message
+		if !decode {
+			msg = rawMessage(qm)
+		} else if qm.Error != nil {
+			// Pushing it would store undecoded payload as plain one.
+			progress.Failed++
+			continue
+		} else {
+			msg = NewMessage(qm.Payload).SetId(qm.Id).SetHeaders(qm.Headers)
+		}
+		msg.SetContext(ctx)
+		if qm.ExpireTs > 0 {
+			msg.SetTtl(uint64(ttl))
+		}
+		pending = append(pending, qm)
+		push = append(push, msg)
+	}
+	if len(push) == 0 {
+		return nil
+	}
+
+	items, err := dst.PushBatch(push...)
+	if err != nil {
+		for _, qm := range pending {
+			src.UnlockByReceipt(qm.Receipt)
+		}
+		return err
+	}
+	for i, qm := range pending {
+		if i >= len(items) || (items[i].Error != nil && !IsIdConflict(items[i].Error)) {
+			progress.Failed++
+			continue
+		}
+		if err := src.DeleteByReceipt(qm.Receipt); err != nil {
+			return err
+		}
+		progress.Moved++
+	}
+	return nil
+}
+
+func loadCheckpoint(path string, progress *MigrateProgress) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved MigrateProgress
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	if saved.Source != progress.Source || saved.Destination != progress.Destination {
+		return ErrCheckpointMismatch
+	}
+	*progress = saved
+	return nil
+}
+
+// saveCheckpoint replaces checkpoint file atomically.
+func saveCheckpoint(path string, progress *MigrateProgress) error {
+	data, err := json.MarshalIndent(progress, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,57 @@
+package pqclient
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/vburenin/firempq_connector/envelope"
+)
+
+// countingStore counts blob reads.
+type countingStore struct {
+	*FileBlobStore
+	gets int
+}
+
+func (s *countingStore) Get(ref string) ([]byte, error) {
+	s.gets++
+	return s.FileBlobStore.Get(ref)
+}
+
+func TestMigrateRawDoesntDecode(t *testing.T) {
+	store, blobs := newTestBlobStore(t)
+	var payloads []string
+	for _, body := range []string{"expired", "moved"} {
+		producer, out := testQueue("+OK\n")
+		producer.SetClaimCheck(store, 0, true)
+		if err := producer.Push(NewMessage(body)); err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, pushedPayload(t, out.String()))
+	}
+
+	expireTs := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	src, _ := testQueue(popResponse(
+		[]string{"ID", "b", "PL", payloads[0], "RCPT", "rb", "ETS", "1"},
+		[]string{"ID", "a", "PL", payloads[1], "RCPT", "ra", "ETS", expireTs},
+	) + "+OK\n+OK\n+MSGS *0\n")
+	counting := &countingStore{FileBlobStore: store}
+	src.SetClaimCheck(counting, 0, true)
+	dst, dstOut := testQueue("+BATCH *1\n+MSG a\n")
+
+	progress, err := Migrate(context.Background(), src, dst, nil)
+	if err != nil || progress.Moved != 1 || progress.Expired != 1 || !progress.Done {
+		t.Fatalf("Unexpected migration result %+v: %v", progress, err)
+	}
+	if counting.gets != 0 {
+		t.Fatalf("%d blobs are fetched by raw migration", counting.gets)
+	}
+	if pushed := pushedBatch(t, dstOut.String()); pushed["a"] != payloads[1] {
+		t.Fatalf("Got payload %q, want %q", pushed["a"], payloads[1])
+	}
+	if blobs() != 1 {
+		t.Fatalf("Got %d blobs, want only the moved message blob", blobs())
+	}
+}
@@ -0,0 +1,298 @@
+package pqclient
+
+import (
+	"context"
+
+	. "github.com/vburenin/firempq_connector/fmpq_err"
+)
+
+// MultiQueueHandler handles a message popped from pq. Message is deleted if handler
+// succeeds and unlocked otherwise. Messages which payload couldn't be decoded
+// are passed to the handler as well with their Error set. If the handler fails them,
+// they are moved into the dead letter queue, see SetDeadLetterQueue, or stay locked
+// until the lock timeout, so they are not redelivered in a tight loop.
+type MultiQueueHandler func(pq *PriorityQueue, msg *QueueMessage) error
+
+// MultiQueueConsumer consumes messages from several queues feeding them into a single handler.
+// Queues are polled either proportionally to their weights or in strict priority order.
+// If all queues are empty, they are long polled in parallel, so idle consumer doesn't burn CPU.
+type MultiQueueConsumer struct {
+	queues      []*weightedQueue
+	handler     MultiQueueHandler
+	strict      bool
+	batchSize   int64
+	lockTimeout int64
+	idleWait    int64
+	deadLetter  *PriorityQueue
+	polls       chan pollResult
+}
+
+type weightedQueue struct {
+	pq      *PriorityQueue
+	weight  int
+	current int
+	// polling is set while a long poll of the queue is in progress.
+	polling bool
+}
+
+// pollResult is a result of a long poll of a single queue.
+type pollResult struct {
+	q    *weightedQueue
+	msgs []*QueueMessage
+	err  error
+}
+
+// NewMultiQueueConsumer creates a consumer popping one message at a time and
+// long polling idle queues for one second.
+func NewMultiQueueConsumer(handler MultiQueueHandler) *MultiQueueConsumer {
+	return &MultiQueueConsumer{
+		handler:     handler,
+		batchSize:   1,
+		lockTimeout: -1,
+		idleWait:    1000,
+	}
+}
+
+// AddQueue adds a queue with a given weight. Weights are ignored in strict priority mode,
+// where queues added first have higher priority. Weight must be positive.
+func (c *MultiQueueConsumer) AddQueue(pq *PriorityQueue, weight int) *MultiQueueConsumer {
+	if weight < 1 {
+		panic("Weight must be positive")
+	}
+	c.queues = append(c.queues, &weightedQueue{pq: pq, weight: weight})
+	return c
+}
+
+// SetStrictPriority enables strict priority mode: a queue is polled only if all
+// queues added before it are empty.
+func (c *MultiQueueConsumer) SetStrictPriority(b bool) *MultiQueueConsumer {
+	c.strict = b
+	return c
+}
+
+// SetBatchSize sets max number of messages popped by a single call. Value must be positive.
+func (c *MultiQueueConsumer) SetBatchSize(v int64) *MultiQueueConsumer {
+	if v < 1 {
+		panic("Value must be positive")
+	}
+	c.batchSize = v
+	return c
+}
+
+// SetLockTimeout sets lock timeout of popped messages in milliseconds. Value must be positive.
+func (c *MultiQueueConsumer) SetLockTimeout(v int64) *MultiQueueConsumer {
+	if v < 0 {
+		panic("Value must be positive")
+	}
+	c.lockTimeout = v
+	return c
+}
+
+// SetIdleWait sets long polling wait timeout in milliseconds used when all queues are empty.
+// Value must be positive.
+func (c *MultiQueueConsumer) SetIdleWait(v int64) *MultiQueueConsumer {
+	if v < 0 {
+		panic("Value must be positive")
+	}
+	c.idleWait = v
+	return c
+}
+
+// SetDeadLetterQueue sets a queue undecodable messages failed by the handler are moved to.
+// They are pushed with their original payload, so they can be decoded later once the reason
+// is fixed, e.g. a missing decryption key is added. Queue must not be used by any other goroutine.
+func (c *MultiQueueConsumer) SetDeadLetterQueue(pq *PriorityQueue) *MultiQueueConsumer {
+	c.deadLetter = pq
+	return c
+}
+
+// Run consumes messages until ctx is done or any queue fails. It returns nil once ctx is done.
+// Cancellation is noticed after the current long polling calls complete, messages they have
+// received are unlocked.
+func (c *MultiQueueConsumer) Run(ctx context.Context) error {
+	c.polls = make(chan pollResult, len(c.queues))
+	err := c.run(ctx)
+	c.stopPolls()
+	return err
+}
+
+func (c *MultiQueueConsumer) run(ctx context.Context) error {
+	for ctx.Err() == nil {
+		// Messages received by long polls which are still in progress are handled first.
+		found, err := c.handlePolls(false)
+		if err != nil {
+			return err
+		}
+		if !found {
+			if found, err = c.pollOnce(ctx); err != nil {
+				return err
+			}
+		}
+		if !found {
+			c.startPolls(ctx)
+			if _, err := c.handlePolls(true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pollOnce pops messages without waiting from the next non empty queue in schedule order.
+// Queues being long polled are skipped.
+func (c *MultiQueueConsumer) pollOnce(ctx context.Context) (bool, error) {
+	tried := make(map[*weightedQueue]bool, len(c.queues))
+	for _, q := range c.queues {
+		if q.polling {
+			tried[q] = true
+		}
+	}
+	for len(tried) < len(c.queues) {
+		q := c.next(tried)
+		tried[q] = true
+		msgs, err := q.pq.PopLock(c.popOptions(ctx, 0))
+		if err != nil {
+			return false, err
+		}
+		if len(msgs) > 0 {
+			return true, c.handle(q.pq, msgs)
+		}
+	}
+	return false, nil
+}
+
+// next returns the next queue to poll skipping already tried queues. It uses smooth
+// weighted round robin, so queues are polled proportionally to their weights.
+func (c *MultiQueueConsumer) next(tried map[*weightedQueue]bool) *weightedQueue {
+	if c.strict {
+		for _, q := range c.queues {
+			if !tried[q] {
+				return q
+			}
+		}
+	}
+	var best *weightedQueue
+	total := 0
+	for _, q := range c.queues {
+		if tried[q] {
+			continue
+		}
+		q.current += q.weight
+		total += q.weight
+		if best == nil || q.current > best.current {
+			best = q
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// startPolls starts long polls of all queues which are not being polled yet.
+// Each queue has at most one poll in progress, so results never block on the channel.
+func (c *MultiQueueConsumer) startPolls(ctx context.Context) {
+	for _, q := range c.queues {
+		if q.polling {
+			continue
+		}
+		q.polling = true
+		go func(q *weightedQueue) {
+			msgs, err := q.pq.PopLock(c.popOptions(ctx, c.idleWait))
+			c.polls <- pollResult{q: q, msgs: msgs, err: err}
+		}(q)
+	}
+}
+
+// handlePolls handles messages of completed long polls as soon as they arrive,
+// waiting for one poll at least if wait is true.
+func (c *MultiQueueConsumer) handlePolls(wait bool) (bool, error) {
+	found := false
+	var firstErr error
+	for {
+		var r pollResult
+		if wait {
+			r = <-c.polls
+			wait = false
+		} else {
+			select {
+			case r = <-c.polls:
+			default:
+				return found, firstErr
+			}
+		}
+		r.q.polling = false
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		if len(r.msgs) > 0 {
+			found = true
+		}
+		if firstErr != nil {
+			unlockAll(r.q.pq, r.msgs)
+		} else if err := c.handle(r.q.pq, r.msgs); err != nil {
+			firstErr = err
+		}
+	}
+}
+
+// stopPolls waits for long polls in progress unlocking messages they have received.
+func (c *MultiQueueConsumer) stopPolls() {
+	inProgress := 0
+	for _, q := range c.queues {
+		if q.polling {
+			inProgress++
+		}
+	}
+	for ; inProgress > 0; inProgress-- {
+		r := <-c.polls
+		r.q.polling = false
+		unlockAll(r.q.pq, r.msgs)
+	}
+}
+
+func unlockAll(pq *PriorityQueue, msgs []*QueueMessage) {
+	for _, msg := range msgs {
+		pq.UnlockByReceipt(msg.Receipt)
+	}
+}
+
+func (c *MultiQueueConsumer) popOptions(ctx context.Context, wait int64) *PopLockOptions {
+	return NewPopLockOptions().
+		SetLimit(c.batchSize).
+		SetWaitTimeout(wait).
+		SetLockTimeout(c.lockTimeout).
+		SetContext(ctx)
+}
+
+func (c *MultiQueueConsumer) handle(pq *PriorityQueue, msgs []*QueueMessage) error {
+	for i, msg := range msgs {
+		var err error
+		switch {
+		case c.handler(pq, msg) == nil:
+			err = pq.DeleteByReceipt(msg.Receipt)
+		case msg.Error == nil:
+			err = pq.UnlockByReceipt(msg.Receipt)
+		case c.deadLetter != nil:
+			err = c.moveToDeadLetter(pq, msg)
+		}
+		if err != nil && !isRejected(err) {
+			// Expired lock only means the message is redelivered, anything else is fatal.
+			unlockAll(pq, msgs[i+1:])
+			return err
+		}
+	}
+	return nil
+}
+
+// moveToDeadLetter pushes message with its original payload into the dead letter queue
+// and deletes it from pq.
+func (c *MultiQueueConsumer) moveToDeadLetter(pq *PriorityQueue, msg *QueueMessage) error {
+	if err := c.deadLetter.Push(rawMessage(msg)); err != nil && !IsIdConflict(err) {
+		return err
+	}
+	// Blob is referenced by the dead letter message now.
+	pq.releaseBlob(msg.Receipt, false)
+	return pq.DeleteByReceipt(msg.Receipt)
+}
@@ -0,0 +1,33 @@
+package pqclient
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestMultiQueueConsumerIgnoresExpiredLocks(t *testing.T) {
+	pq, out := testQueue("+MSGS *2 %2 ID a RCPT r1 %2 ID b RCPT r2\n" +
+		"-ERR 404 $17 Receipt not found\n" +
+		"+OK\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var handled []string
+	c := NewMultiQueueConsumer(func(pq *PriorityQueue, msg *QueueMessage) error {
+		handled = append(handled, msg.Id)
+		if len(handled) == 2 {
+			cancel()
+		}
+		return nil
+	}).AddQueue(pq, 1).SetBatchSize(2)
+
+	if err := c.Run(ctx); err != nil {
+		t.Fatalf("Expired lock stopped the consumer: %v", err)
+	}
+	if len(handled) != 2 {
+		t.Fatalf("Handled %q, want both messages", handled)
+	}
+	if cmds := out.String(); !strings.Contains(cmds, "RDEL $2 r1\n") || !strings.Contains(cmds, "RDEL $2 r2\n") {
+		t.Fatalf("Unexpected commands: %q", cmds)
+	}
+}
@@ -1,7 +1,10 @@
 package pqclient
 
 import (
-	. "github.com/vburenin/firempq_connector/encoders"
+	"bufio"
+	"context"
+
+	. "github.com/vburenin/firempq_connector/netutils"
 )
 
 var popPrmPopWait = []byte("WAIT")
@@ -9,114 +12,157 @@ var popPrmLockTimeoutT = []byte("TIMEOUT")
 var popPrmLimit = []byte("LIMIT")
 var popPrmAsync = []byte("ASYNC")
 
-// popOptions are used to set POP call parameters.
-type popOptions struct {
+// PopOptions are used to set POP call parameters.
+type PopOptions struct {
 	limit         int64
 	waitTimeout   int64
 	asyncCallback func(*PriorityQueue, error)
 	asyncId       string
+	ctx           context.Context
 }
 
 // NewPopOptions returns an empty instance of POP options.
-func NewPopOptions() *popOptions {
-	return &popOptions{}
+func NewPopOptions() *PopOptions {
+	return &PopOptions{}
 }
 
 // SetLimit sets user defined limit. Upper bound is defined by service config.
-func (opts *popOptions) SetLimit(limit int64) *popOptions {
+func (opts *PopOptions) SetLimit(limit int64) *PopOptions {
 	opts.limit = limit
 	return opts
 }
 
 // SetWaitTimeout sets wait timeout in milliseconds if no messages are available in the queue.
 // Max limit defined by service config.
-func (opts *popOptions) SetWaitTimeout(waitTimeout int64) *popOptions {
+func (opts *PopOptions) SetWaitTimeout(waitTimeout int64) *PopOptions {
 	opts.waitTimeout = waitTimeout
 	return opts
 }
 
-func (opts *popOptions) SetAsyncCallback(cb func(*PriorityQueue, error)) *popOptions {
+func (opts *PopOptions) SetAsyncCallback(cb func(*PriorityQueue, error)) *PopOptions {
 	opts.asyncCallback = cb
 	return opts
 }
 
-func (opts *popOptions) makeRequest() [][]byte {
+// SetContext sets a context used while waiting for pop rate limiter and as a parent of a client span.
+func (opts *PopOptions) SetContext(ctx context.Context) *PopOptions {
+	opts.ctx = ctx
+	return opts
+}
+
+func (opts *PopOptions) context() context.Context {
+	if opts == nil || opts.ctx == nil {
+		return context.Background()
+	}
+	return opts.ctx
+}
+
+// expectedCount returns max number of messages pop call may return.
+func (opts *PopOptions) expectedCount() int {
+	if opts == nil || opts.limit < 1 {
+		return 1
+	}
+	return int(opts.limit)
+}
+
+func (opts *PopOptions) writeTo(w *bufio.Writer) {
 	if opts == nil {
-		return nil
+		return
 	}
-	args := make([][]byte, 0, 2)
 	if opts.limit > 0 {
-		args = append(args, popPrmLimit)
-		args = append(args, EncodeInt64(opts.limit))
+		WriteArg(w, popPrmLimit)
+		WriteIntArg(w, opts.limit)
 	}
 	if opts.waitTimeout > 0 {
-		args = append(args, popPrmPopWait)
-		args = append(args, EncodeInt64(opts.waitTimeout))
+		WriteArg(w, popPrmPopWait)
+		WriteIntArg(w, opts.waitTimeout)
 	}
 	if opts.asyncId != "" {
-		args = append(args, popPrmAsync)
-		args = append(args, EncodeString(opts.asyncId))
+		WriteArg(w, popPrmAsync)
+		WriteStringArg(w, opts.asyncId)
 	}
-	return args
 }
 
-type popLockOptions struct {
+// PopLockOptions are used to set POPLOCK call parameters.
+type PopLockOptions struct {
 	limit         int64
 	waitTimeout   int64
 	lockTimeout   int64
 	asyncCallback func(*PriorityQueue, error)
 	asyncId       string
+	ctx           context.Context
+	// raw skips payload decoding, so payloads are returned as they are stored.
+	raw bool
 }
 
-func NewPopLockOptions() *popLockOptions {
-	return &popLockOptions{lockTimeout: -1}
+func NewPopLockOptions() *PopLockOptions {
+	return &PopLockOptions{lockTimeout: -1}
 }
 
 // SetLimit sets user defined limit. Upper bound is defined by service config.
-func (opts *popLockOptions) SetLimit(limit int64) *popLockOptions {
+func (opts *PopLockOptions) SetLimit(limit int64) *PopLockOptions {
 	opts.limit = limit
 	return opts
 }
 
 // SetWaitTimeout sets wait timeout in milliseconds if no messages are available in the queue.
 // Max limit defined by service config.
-func (opts *popLockOptions) SetWaitTimeout(waitTimeout int64) *popLockOptions {
+func (opts *PopLockOptions) SetWaitTimeout(waitTimeout int64) *PopLockOptions {
 	opts.waitTimeout = waitTimeout
 	return opts
 }
 
-func (opts *popLockOptions) SetLockTimeout(lockTimeout int64) *popLockOptions {
+func (opts *PopLockOptions) SetLockTimeout(lockTimeout int64) *PopLockOptions {
 	opts.lockTimeout = lockTimeout
 	return opts
 }
 
-func (opts *popLockOptions) SetAsyncCallback(cb func(*PriorityQueue, error)) *popLockOptions {
+func (opts *PopLockOptions) SetAsyncCallback(cb func(*PriorityQueue, error)) *PopLockOptions {
 	opts.asyncCallback = cb
 	return opts
 }
 
-func (opts *popLockOptions) makeRequest() [][]byte {
+// SetContext sets a context used while waiting for pop rate limiter and as a parent of a client span.
+func (opts *PopLockOptions) SetContext(ctx context.Context) *PopLockOptions {
+	opts.ctx = ctx
+	return opts
+}
+
+func (opts *PopLockOptions) context() context.Context {
+	if opts == nil || opts.ctx == nil {
+		return context.Background()
+	}
+	return opts.ctx
+}
+
+// expectedCount returns max number of messages pop call may return.
+func (opts *PopLockOptions) expectedCount() int {
+	if opts == nil || opts.limit < 1 {
+		return 1
+	}
+	return int(opts.limit)
+}
+
+func (opts *PopLockOptions) writeTo(w *bufio.Writer) {
 	if opts == nil {
-		return nil
+		return
 	}
-	args := make([][]byte, 0, 2)
 	if opts.limit != 0 {
-		args = append(args, popPrmLimit)
-		args = append(args, EncodeInt64(opts.limit))
+		WriteArg(w, popPrmLimit)
+		WriteIntArg(w, opts.limit)
 	}
 	if opts.waitTimeout > 0 {
-		args = append(args, popPrmPopWait)
-		args = append(args, EncodeInt64(opts.waitTimeout))
+		WriteArg(w, popPrmPopWait)
+		WriteIntArg(w, opts.waitTimeout)
 	}
 	if opts.lockTimeout >= 0 {
-		args = append(args, popPrmLockTimeoutT)
-		args = append(args, EncodeInt64(opts.lockTimeout))
+		WriteArg(w, popPrmLockTimeoutT)
+		WriteIntArg(w, opts.lockTimeout)
 	}
 	if opts.asyncId != "" {
-		args = append(args, popPrmAsync)
-		args = append(args, EncodeString(opts.asyncId))
+		WriteArg(w, popPrmAsync)
+		WriteStringArg(w, opts.asyncId)
 	}
-	return args
 }
 
 type PqParams struct {
@@ -188,36 +234,33 @@ var pqOptDelay = []byte("DELAY")
 var pqOptPopLimit = []byte("POPLIMIT")
 var pqOptLockTimeout = []byte("TIMEOUT")
 
-func (opts *PqParams) makeRequest() [][]byte {
+func (opts *PqParams) writeTo(w *bufio.Writer) {
 	if opts == nil {
-		return nil
+		return
 	}
 
-	args := make([][]byte, 0, 2)
 	if opts.msgTtl > 0 {
-		args = append(args, pqOptLimit)
-		args = append(args, EncodeInt64(opts.msgTtl))
+		WriteArg(w, pqOptLimit)
+		WriteIntArg(w, opts.msgTtl)
 	}
 
 	if opts.maxSize > 0 {
-		args = append(args, pqOptMaxSize)
-		args = append(args, EncodeInt64(opts.maxSize))
+		WriteArg(w, pqOptMaxSize)
+		WriteIntArg(w, opts.maxSize)
 	}
 
 	if opts.delay >= 0 {
-		args = append(args, pqOptDelay)
-		args = append(args, EncodeInt64(opts.delay))
+		WriteArg(w, pqOptDelay)
+		WriteIntArg(w, opts.delay)
 	}
 
 	if opts.popLimit >= 0 {
-		args = append(args, pqOptPopLimit)
-		args = append(args, EncodeInt64(opts.popLimit))
+		WriteArg(w, pqOptPopLimit)
+		WriteIntArg(w, opts.popLimit)
 	}
 
 	if opts.lockTimeout >= 0 {
-		args = append(args, pqOptLockTimeout)
-		args = append(args, EncodeInt64(opts.lockTimeout))
+		WriteArg(w, pqOptLockTimeout)
+		WriteIntArg(w, opts.lockTimeout)
 	}
-
-	return args
 }
@@ -0,0 +1,317 @@
+package pqclient
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	. "github.com/vburenin/firempq_connector/envelope"
+	. "github.com/vburenin/firempq_connector/fmpq_err"
+)
+
+var ErrNoBlobStore = errors.New("Message payload is stored in a blob store, but blob store is not configured")
+
+// lockedBlobsPruneMin is the min number of remembered blobs of locked messages
+// before the ones with expired locks are forgotten.
+const lockedBlobsPruneMin = 64
+
+// lockedBlob is a blob of a message popped with PopLock.
+type lockedBlob struct {
+	ref      string
+	id       string
+	unlockTs int64
+}
+
+// SetCompression enables compression of message payloads which are at least minSize bytes long.
+// Payloads are sent uncompressed if compression doesn't make them smaller.
+// Popped messages are decompressed automatically using registered compressors.
+func (pq *PriorityQueue) SetCompression(c Compressor, minSize int) *PriorityQueue {
+	pq.compressor = c
+	pq.compressMinSize = minSize
+	return pq
+}
+
+// SetEncryption enables AES-GCM encryption of message payloads. Popped messages
+// encrypted with keys unknown to the provider get UnknownKeyError set as their Error.
+func (pq *PriorityQueue) SetEncryption(kp KeyProvider) *PriorityQueue {
+	pq.keyProvider = kp
+	return pq
+}
+
+// SetClaimCheck enables claim-check mode: payloads which are at least minSize bytes long
+// after compression and encryption are saved into the blob store and only their
+// references are pushed into the queue. Popped messages fetch payloads from the store
+// transparently. If gc is true, DeleteByReceipt and DeleteLockedById delete the blob of
+// the message popped with PopLock by this queue while its lock is valid. Blobs of messages
+// consumed with Pop are never deleted. Blobs of messages rejected by the service on push
+// are deleted, blobs of messages whose push failed with an I/O error are kept, since the
+// message may have been stored.
+func (pq *PriorityQueue) SetClaimCheck(store BlobStore, minSize int, gc bool) *PriorityQueue {
+	pq.blobStore = store
+	pq.claimMinSize = minSize
+	pq.blobGc = gc
+	if gc && pq.lockedBlobs == nil {
+		pq.lockedBlobs = make(map[string]lockedBlob)
+	}
+	return pq
+}
+
+// payload returns message payload to be sent to the service. Payload is wrapped into
+// an envelope only if there are headers or payload encodings to record.
+// Trace context found in ctx is injected into the envelope headers.
+func (pq *PriorityQueue) payload(msg *Message, ctx context.Context) (string, error) {
+	if msg.raw {
+		return msg.payload, nil
+	}
+	body := msg.payload
+	var encodings []string
+
+	if pq.compressor != nil && len(body) >= pq.compressMinSize {
+		data, err := pq.compressor.Compress([]byte(body))
+		if err != nil {
+			return "", err
+		}
+		if len(data) < len(body) {
+			name := pq.compressor.Name()
+			pq.metrics.PayloadCompressed(pq.queueName, name, len(body), len(data))
+			body = string(data)
+			encodings = append(encodings, name)
+		}
+	}
+
+	if pq.keyProvider != nil {
+		data, err := Encrypt(pq.keyProvider, []byte(body))
+		if err != nil {
+			return "", err
+		}
+		body = string(data)
+		encodings = append(encodings, EncodingAesGcm)
+	}
+
+	if pq.blobStore != nil && len(body) >= pq.claimMinSize {
+		ref, err := pq.blobStore.Put([]byte(body))
+		if err != nil {
+			return "", err
+		}
+		body = ref
+		encodings = append(encodings, EncodingClaimCheck)
+	}
+
+	var headers map[string]string
+	if pq.tracer != nil || len(msg.headers) > 0 {
+		headers = make(map[string]string, len(msg.headers)+2)
+		for k, v := range msg.headers {
+			headers[k] = v
+		}
+		if pq.tracer != nil {
+			pq.tracer.Inject(ctx, headers)
+		}
+	}
+
+	if len(headers) == 0 && len(encodings) == 0 {
+		return body, nil
+	}
+	return Marshal(&Envelope{Headers: headers, Encodings: encodings, Body: body}), nil
+}
+
+// traceContext returns context to be injected into a message sent within the command span:
+// the span context, unless message has a context of its own different from the parent one
+// the span has been started in, which may happen to messages of a batch.
+func traceContext(msg *Message, parent, spanCtx context.Context) context.Context {
+	if msg.ctx != nil && msg.ctx != parent {
+		return msg.ctx
+	}
+	return spanCtx
+}
+
+// extractContext restores trace context of popped messages.
+func (pq *PriorityQueue) extractContext(msgs []*QueueMessage) {
+	if pq.tracer == nil {
+		return
+	}
+	for _, m := range msgs {
+		pq.extractMessageContext(m)
+	}
+}
+
+func (pq *PriorityQueue) extractMessageContext(msg *QueueMessage) {
+	if pq.tracer != nil && msg.Headers != nil {
+		msg.ctx = pq.messageContext(context.Background(), msg)
+	}
+}
+
+// messageContext returns ctx carrying trace context of a popped message.
+func (pq *PriorityQueue) messageContext(ctx context.Context, msg *QueueMessage) context.Context {
+	if pq.tracer != nil && msg.Headers != nil {
+		return pq.tracer.Extract(ctx, msg.Headers)
+	}
+	return ctx
+}
+
+// unwrapEnvelope unwraps message payload envelope if there is one, restoring
+// message headers. Payload encodings are decoded later by decodePayloads.
+func unwrapEnvelope(msg *QueueMessage) {
+	msg.raw = msg.Payload
+	if !IsEnvelope(msg.Payload) {
+		return
+	}
+	env, err := Unmarshal(msg.Payload)
+	if err != nil {
+		msg.Error = WrongMessageFormatError(err.Error())
+		return
+	}
+	msg.Payload = env.Body
+	msg.encodings = env.Encodings
+	if len(env.Headers) > 0 {
+		msg.Headers = env.Headers
+	}
+}
+
+// decodePayloads reverts payload encodings of popped messages. Messages which can't
+// be decoded get their Error set, so they can be handled individually.
+func (pq *PriorityQueue) decodePayloads(msgs []*QueueMessage) {
+	for _, msg := range msgs {
+		pq.decodePayload(msg)
+	}
+}
+
+func (pq *PriorityQueue) decodePayload(msg *QueueMessage) {
+	if msg.Error != nil || len(msg.encodings) == 0 {
+		return
+	}
+	body := []byte(msg.Payload)
+	var err error
+	for i := len(msg.encodings) - 1; i >= 0 && err == nil; i-- {
+		if msg.encodings[i] == EncodingClaimCheck {
+			body, err = pq.fetchBlob(msg, string(body))
+		} else {
+			body, err = pq.decodeBody(msg.encodings[i], body)
+		}
+	}
+	if err != nil {
+		msg.Error = err
+		return
+	}
+	msg.Payload = string(body)
+	msg.encodings = nil
+}
+
+func (pq *PriorityQueue) decodeBody(encoding string, body []byte) ([]byte, error) {
+	if encoding == EncodingAesGcm {
+		kp := pq.keyProvider
+		if kp == nil {
+			kp = noKeys{}
+		}
+		return Decrypt(kp, body)
+	}
+	c, ok := GetCompressor(encoding)
+	if !ok {
+		return nil, WrongMessageFormatError("Unknown payload encoding: " + encoding)
+	}
+	data, err := c.Decompress(body)
+	if err != nil {
+		return nil, WrongMessageFormatError(err.Error())
+	}
+	return data, nil
+}
+
+// fetchBlob loads payload from the blob store remembering its reference
+// for garbage collection if message is locked.
+func (pq *PriorityQueue) fetchBlob(msg *QueueMessage, ref string) ([]byte, error) {
+	if pq.blobStore == nil {
+		return nil, ErrNoBlobStore
+	}
+	data, err := pq.blobStore.Get(ref)
+	if err != nil {
+		return nil, err
+	}
+	if pq.blobGc && msg.Receipt != "" {
+		pq.pruneLockedBlobs()
+		pq.lockedBlobs[msg.Receipt] = lockedBlob{ref: ref, id: msg.Id, unlockTs: msg.UnlockTs}
+	}
+	return data, nil
+}
+
+// pruneLockedBlobs forgets blobs of messages whose locks have expired. It scans the map
+// only once it has doubled since the previous scan, keeping the amortized cost constant.
+func (pq *PriorityQueue) pruneLockedBlobs() {
+	if len(pq.lockedBlobs) < pq.blobPruneAt {
+		return
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for rcpt, b := range pq.lockedBlobs {
+		if b.unlockTs <= now {
+			delete(pq.lockedBlobs, rcpt)
+		}
+	}
+	pq.blobPruneAt = max(2*len(pq.lockedBlobs), lockedBlobsPruneMin)
+}
+
+// releaseBlob forgets the blob of a locked message and deletes it from the store if requested.
+func (pq *PriorityQueue) releaseBlob(rcpt string, deleteBlob bool) {
+	b, ok := pq.lockedBlobs[rcpt]
+	if !ok {
+		return
+	}
+	delete(pq.lockedBlobs, rcpt)
+	if deleteBlob {
+		// Message is already deleted, so failure leaves an orphaned blob only.
+		pq.blobStore.Delete(b.ref)
+	}
+}
+
+// releaseBlobById is the same as releaseBlob for messages unlocked or deleted by id.
+func (pq *PriorityQueue) releaseBlobById(id string, deleteBlob bool) {
+	for rcpt, b := range pq.lockedBlobs {
+		if b.id == id {
+			pq.releaseBlob(rcpt, deleteBlob)
+			return
+		}
+	}
+}
+
+// dropPayload deletes the blob referenced by an encoded payload the service hasn't stored.
+func (pq *PriorityQueue) dropPayload(payload *string) {
+	if pq.blobStore == nil || *payload == "" {
+		return
+	}
+	env, err := Unmarshal(*payload)
+	*payload = ""
+	if err != nil || len(env.Encodings) == 0 || env.Encodings[len(env.Encodings)-1] != EncodingClaimCheck {
+		return
+	}
+	pq.blobStore.Delete(env.Body)
+}
+
+// dropPayloads is the same as dropPayload for several payloads.
+func (pq *PriorityQueue) dropPayloads(payloads []string) {
+	for i := range payloads {
+		pq.dropPayload(&payloads[i])
+	}
+}
+
+// dropRejected deletes blobs of batch messages rejected by the service.
+func (pq *PriorityQueue) dropRejected(payloads []string, items []PushBatchItem, err error) {
+	for i := range payloads {
+		if isRejected(err) || (i < len(items) && isRejected(items[i].Error)) {
+			pq.dropPayload(&payloads[i])
+		}
+	}
+}
+
+// isRejected returns true if the service has refused a command, so it had no effect.
+func isRejected(err error) bool {
+	e, ok := err.(*FireMpqError)
+	return ok && e.Code >= 0
+}
+
+// noKeys is a key provider used to decode encrypted messages if encryption is not configured.
+type noKeys struct{}
+
+func (noKeys) CurrentKey() (string, []byte, error) {
+	return "", nil, ErrNoCurrentKey
+}
+
+func (noKeys) Key(id string) ([]byte, error) {
+	return nil, &UnknownKeyError{KeyId: id}
+}
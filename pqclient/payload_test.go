@@ -0,0 +1,140 @@
+package pqclient
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	. "github.com/vburenin/firempq_connector/envelope"
+)
+
+var errTestPut = errors.New("Put failed")
+
+// failingStore fails every Put after the first ok ones.
+type failingStore struct {
+	*FileBlobStore
+	ok int
+}
+
+func (s *failingStore) Put(data []byte) (string, error) {
+	if s.ok == 0 {
+		return "", errTestPut
+	}
+	s.ok--
+	return s.FileBlobStore.Put(data)
+}
+
+// failingWriter fails all writes.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, os.ErrClosed
+}
+
+func newTestBlobStore(t *testing.T) (*FileBlobStore, func() int) {
+	dir := t.TempDir()
+	store, err := NewFileBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, func() int {
+		ents, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(ents)
+	}
+}
+
+func TestClaimCheckRoundTrip(t *testing.T) {
+	store, blobs := newTestBlobStore(t)
+	producer, out := testQueue("+OK\n")
+	producer.SetClaimCheck(store, 0, true)
+	if err := producer.Push(NewMessage("large payload")); err != nil {
+		t.Fatal(err)
+	}
+	payload := pushedPayload(t, out.String())
+	if blobs() != 1 {
+		t.Fatalf("Got %d blobs, want 1", blobs())
+	}
+
+	consumer, _ := testQueue("+MSGS *1 %3 ID a RCPT r1 PL $" + strconv.Itoa(len(payload)) + " " + payload + "\n" +
+		"+OK\n")
+	consumer.SetClaimCheck(store, 0, true)
+	msgs, err := consumer.PopLock(NewPopLockOptions())
+	if err != nil || len(msgs) != 1 || msgs[0].Error != nil || msgs[0].Payload != "large payload" {
+		t.Fatalf("Unexpected pop result %+v: %v", msgs, err)
+	}
+	if err := consumer.DeleteByReceipt(msgs[0].Receipt); err != nil {
+		t.Fatal(err)
+	}
+	if blobs() != 0 {
+		t.Fatal("Blob is kept after the message is deleted")
+	}
+}
+
+func TestPushBatchDropsBlobsOnEncodingFailure(t *testing.T) {
+	store, blobs := newTestBlobStore(t)
+	pq, _ := testQueue("")
+	pq.SetClaimCheck(&failingStore{FileBlobStore: store, ok: 2}, 0, true)
+	if _, err := pq.PushBatch(batchMessages("1", "2", "3")...); err != errTestPut {
+		t.Fatalf("Got %v, want Put failure", err)
+	}
+	if blobs() != 0 {
+		t.Fatalf("%d blobs of unsent messages are kept", blobs())
+	}
+}
+
+func TestPushDropsBlobOnWriteFailure(t *testing.T) {
+	store, blobs := newTestBlobStore(t)
+	pq, _ := testQueue("")
+	pq.bufWriter = bufio.NewWriter(failingWriter{})
+	pq.SetClaimCheck(store, 0, true)
+	if err := pq.Push(NewMessage("1")); err == nil {
+		t.Fatal("Push succeeded")
+	}
+	if _, err := pq.PushBatch(batchMessages("1", "2")...); err == nil {
+		t.Fatal("PushBatch succeeded")
+	}
+	if blobs() != 0 {
+		t.Fatalf("%d blobs of unsent messages are kept", blobs())
+	}
+}
+
+func TestCompression(t *testing.T) {
+	body := strings.Repeat("compressible payload ", 100)
+	producer, out := testQueue("+OK\n")
+	producer.SetCompression(NewGzipCompressor(gzip.BestSpeed), 0)
+	if err := producer.Push(NewMessage(body)); err != nil {
+		t.Fatal(err)
+	}
+	payload := pushedPayload(t, out.String())
+	env, err := Unmarshal(payload)
+	if err != nil || len(env.Encodings) != 1 || env.Encodings[0] != "gzip" || len(payload) >= len(body) {
+		t.Fatalf("Payload is not compressed: %+v, %v", env, err)
+	}
+
+	consumer, _ := testQueue("+MSGS *1 %2 ID a PL $" + strconv.Itoa(len(payload)) + " " + payload + "\n")
+	msgs, err := consumer.Pop(NewPopOptions())
+	if err != nil || len(msgs) != 1 || msgs[0].Error != nil || msgs[0].Payload != body {
+		t.Fatalf("Unexpected pop result %+v: %v", msgs, err)
+	}
+}
+
+func TestCompressionKeepsPayloadsWhichDontShrink(t *testing.T) {
+	pq, out := testQueue("+OK\n+OK\n")
+	pq.SetCompression(NewGzipCompressor(gzip.BestCompression), 10)
+	for _, body := range []string{"short", "0123456789abcdef"} {
+		out.Reset()
+		if err := pq.Push(NewMessage(body)); err != nil {
+			t.Fatal(err)
+		}
+		if payload := pushedPayload(t, out.String()); payload != body {
+			t.Errorf("Got payload %q, want %q sent as is", payload, body)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package pqclient
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	. "github.com/vburenin/firempq_connector/fmpq_err"
+	. "github.com/vburenin/firempq_connector/netutils"
+	. "github.com/vburenin/firempq_connector/parsers"
+)
+
+var (
+	cmdPeek    = "PEEK"
+	cmdMsgInfo = "MSGINFO"
+)
+
+// peekLockTimeout is a lock timeout in milliseconds used to peek messages if the service
+// doesn't support PEEK. It is the smallest positive one, zero means the queue default.
+const peekLockTimeout = 1
+
+var ErrInvalidPeekLimit = errors.New("Peek limit must be positive")
+
+// MessageInfo is a state of a queue message.
+type MessageInfo struct {
+	Id       string
+	ExpireTs int64
+	UnlockTs int64
+	PopCount int64
+}
+
+// Locked returns true if message is locked or delayed.
+func (mi *MessageInfo) Locked() bool {
+	return mi.UnlockTs > time.Now().UnixNano()/int64(time.Millisecond)
+}
+
+// Peek returns up to n messages from the head of the queue without consuming them.
+// If the service doesn't support PEEK, messages are popped with a lock of one millisecond
+// and unlocked right away. In this case their PopCount is incremented, they are invisible
+// to consumers until they are unlocked and messages locked by consumers are not returned.
+func (pq *PriorityQueue) Peek(n int64) ([]*QueueMessage, error) {
+	if n < 1 {
+		return nil, ErrInvalidPeekLimit
+	}
+	if !pq.noPeek {
+		msgs, err := pq.peek(n)
+		if !IsUnknownCommand(err) {
+			return msgs, err
+		}
+		pq.noPeek = true
+	}
+
+	msgs, err := pq.PopLock(NewPopLockOptions().SetLimit(n).SetLockTimeout(peekLockTimeout))
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		// Service errors only mean the lock has already expired.
+		if err := pq.UnlockByReceipt(msg.Receipt); err != nil {
+			if _, ok := err.(*FireMpqError); !ok {
+				return msgs, err
+			}
+		}
+		msg.Receipt = ""
+	}
+	return msgs, nil
+}
+
+func (pq *PriorityQueue) peek(n int64) ([]*QueueMessage, error) {
+	var msgs []*QueueMessage
+	err := pq.call(context.Background(), cmdPeek, func(context.Context) error {
+		pq.bufWriter.WriteString(cmdPeek)
+		WriteArg(pq.bufWriter, prmLimit)
+		WriteIntArg(pq.bufWriter, n)
+		if err := CompleteWrite(pq.bufWriter); err != nil {
+			return err
+		}
+		var err error
+		if msgs, err = pq.handleMessages(); err != nil {
+			return err
+		}
+		pq.decodePayloads(msgs)
+		pq.extractContext(msgs)
+		return nil
+	})
+	return msgs, err
+}
+
+// GetMessageInfo returns the state of a message with the given id.
+func (pq *PriorityQueue) GetMessageInfo(id string) (*MessageInfo, error) {
+	var info *MessageInfo
+	err := pq.call(context.Background(), cmdMsgInfo, func(context.Context) error {
+		pq.bufWriter.WriteString(cmdMsgInfo)
+		WriteStringArg(pq.bufWriter, id)
+		if err := CompleteWrite(pq.bufWriter); err != nil {
+			return err
+		}
+		tokens, err := pq.tokReader.ReadTokens()
+		if err != nil {
+			return err
+		}
+		if len(tokens) > 0 && tokens[0] == "+MSGINFO" {
+			info, err = parseMessageInfo(tokens[1:])
+			return err
+		}
+		if err := ParseError(tokens); err != nil {
+			return err
+		}
+		return UnexpectedResponse(tokens)
+	})
+	return info, err
+}
+
+// parseMessageInfo parses message info key value pairs which may be prefixed with a map header.
+func parseMessageInfo(tokens []string) (*MessageInfo, error) {
+	if len(tokens) > 0 && strings.HasPrefix(tokens[0], "%") {
+		size, err := ParseMapSize(tokens[0])
+		if err != nil {
+			return nil, err
+		}
+		tokens = tokens[1:]
+		if int64(len(tokens)) < size<<1 {
+			return nil, WrongMessageFormatError("Message info ends unexpectedly")
+		}
+		tokens = tokens[:size<<1]
+	}
+	if len(tokens)%2 != 0 {
+		return nil, WrongMessageFormatError("Message info has odd number of tokens")
+	}
+	msg, err := parseMessage(tokens)
+	if err != nil {
+		return nil, err
+	}
+	return &MessageInfo{
+		Id:       msg.Id,
+		ExpireTs: msg.ExpireTs,
+		UnlockTs: msg.UnlockTs,
+		PopCount: msg.PopCount,
+	}, nil
+}
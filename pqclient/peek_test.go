@@ -0,0 +1,34 @@
+package pqclient
+
+import (
+	"testing"
+)
+
+func TestPeekRejectsInvalidLimit(t *testing.T) {
+	pq, out := testQueue("")
+	if _, err := pq.Peek(0); err != ErrInvalidPeekLimit {
+		t.Fatalf("Got %v, want ErrInvalidPeekLimit", err)
+	}
+	if out.Len() != 0 {
+		t.Fatalf("Unexpected commands %q", out.String())
+	}
+}
+
+func TestPeekFallsBackToPopLock(t *testing.T) {
+	pq, out := testQueue("-ERR 400 $15 Unknown command\n" +
+		"+MSGS *1 %3 ID a PL $1 x RCPT r1\n+OK\n" +
+		"+MSGS *0\n")
+	msgs, err := pq.Peek(2)
+	if err != nil || len(msgs) != 1 || msgs[0].Id != "a" || msgs[0].Receipt != "" {
+		t.Fatalf("Unexpected peek result %+v: %v", msgs, err)
+	}
+	if _, err := pq.Peek(2); err != nil {
+		t.Fatal(err)
+	}
+	want := "PEEK LIMIT 2\n" +
+		"POPLCK LIMIT 2 TIMEOUT 1\nRUNLCK $2 r1\n" +
+		"POPLCK LIMIT 2 TIMEOUT 1\n"
+	if out.String() != want {
+		t.Fatalf("Got commands %q, want %q", out.String(), want)
+	}
+}
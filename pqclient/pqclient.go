@@ -2,21 +2,56 @@ package pqclient
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"time"
 
 	. "github.com/vburenin/firempq_connector/api"
-	. "github.com/vburenin/firempq_connector/encoders"
+	. "github.com/vburenin/firempq_connector/envelope"
 	. "github.com/vburenin/firempq_connector/fmpq_err"
+	. "github.com/vburenin/firempq_connector/metrics"
 	. "github.com/vburenin/firempq_connector/netutils"
 	. "github.com/vburenin/firempq_connector/parsers"
+	. "github.com/vburenin/firempq_connector/ratelimit"
+	. "github.com/vburenin/firempq_connector/tracing"
 )
 
 type PriorityQueue struct {
+	conn      io.Closer
 	bufWriter *bufio.Writer
 	tokReader ITokenReader
 	queueName string
 	asyncPop  map[string]func([]QueueMessage, error)
+	metrics   Metrics
+	tracer    Tracer
+
+	compressor      Compressor
+	compressMinSize int
+	keyProvider     KeyProvider
+	blobStore       BlobStore
+	claimMinSize    int
+	blobGc          bool
+	lockedBlobs     map[string]lockedBlob
+	blobPruneAt     int
+
+	pushMsgLimiter  *Limiter
+	pushByteLimiter *Limiter
+	popLimiter      *Limiter
+	fullQueuePolicy *FullQueuePolicy
+	breaker         *CircuitBreaker
+
+	batchMaxCount int
+	batchMaxBytes int
+
+	noPeek   bool
+	payloads []string
+	connErr  error
 }
 
+var ErrConnectionDesync = errors.New("Connection is out of sync with the service")
+
 var (
 	cmdPush             = "PUSH"
 	cmdPushBatch        = "PUSHB"
@@ -39,7 +74,9 @@ type PushBatchItem struct {
 }
 
 func SetPQueueContext(queueName string, bufWriter *bufio.Writer, tokReader ITokenReader) (*PriorityQueue, error) {
-	if err := SendCommand(bufWriter, cmdCtx, EncodeString(queueName)); err != nil {
+	bufWriter.WriteString(cmdCtx)
+	WriteStringArg(bufWriter, queueName)
+	if err := CompleteWrite(bufWriter); err != nil {
 		return nil, err
 	}
 
@@ -51,14 +88,16 @@ func SetPQueueContext(queueName string, bufWriter *bufio.Writer, tokReader IToke
 		bufWriter: bufWriter,
 		tokReader: tokReader,
 		queueName: queueName,
+		metrics:   NopMetrics{},
 	}
 	return pq, nil
 }
 
 func CreatePQueue(queueName string, bufWriter *bufio.Writer, tokReader ITokenReader, opts *PqParams) (*PriorityQueue, error) {
 
-	SendCommand(bufWriter, cmdCrt, []byte(queueName))
-	SendData(bufWriter, opts.makeRequest()...)
+	bufWriter.WriteString(cmdCrt)
+	WriteArg(bufWriter, []byte(queueName))
+	opts.writeTo(bufWriter)
 	CompleteWrite(bufWriter)
 
 	if err := HandleOk(tokReader); err != nil {
@@ -72,105 +111,414 @@ func (pq *PriorityQueue) GetName() string {
 	return pq.queueName
 }
 
+// Close closes queue connection if the queue has been created by FireMpqClient.
+func (pq *PriorityQueue) Close() error {
+	if pq.conn == nil {
+		return nil
+	}
+	return pq.conn.Close()
+}
+
 func (pq *PriorityQueue) NewMessage(payload string) *Message {
 	return NewMessage(payload)
 }
 
+// call executes a single command round trip reporting its outcome to the metrics collector
+// and wrapping it into a client span if tracing is enabled. f receives the span context.
+// Call fails fast if circuit breaker is open.
+func (pq *PriorityQueue) call(ctx context.Context, cmd string, f func(ctx context.Context) error) error {
+	if pq.connErr != nil {
+		return ErrConnectionDesync
+	}
+	if pq.breaker != nil {
+		if err := pq.breaker.Allow(); err != nil {
+			return err
+		}
+	}
+	var span Span
+	if pq.tracer != nil {
+		ctx, span = pq.tracer.Start(ctx, cmd)
+		span.SetAttribute("messaging.system", "firempq")
+		span.SetAttribute("messaging.destination", pq.queueName)
+	}
+	start := time.Now()
+	err := f(ctx)
+	if isDesync(err) {
+		pq.connErr = err
+		pq.metrics.ConnectionLost(pq.queueName)
+	}
+	pq.metrics.CommandDone(pq.queueName, cmd, time.Since(start), err)
+	if pq.breaker != nil {
+		pq.breaker.Done(err)
+	}
+	if span != nil {
+		if err != nil {
+			span.SetError(err)
+		}
+		span.End()
+	}
+	return err
+}
+
+// ConnError returns an error which left the connection out of sync with the service or nil.
+// Once it is set, all queue commands fail with ErrConnectionDesync and the queue has to be
+// closed and opened again.
+func (pq *PriorityQueue) ConnError() error {
+	return pq.connErr
+}
+
+// isDesync returns true if error may have left a response partially read, so the following
+// responses can't be matched to their commands anymore.
+func isDesync(err error) bool {
+	if err == nil {
+		return false
+	}
+	if e, ok := err.(*FireMpqError); ok {
+		// Negative codes are used for malformed responses.
+		return e.Code < 0
+	}
+	return isIoFailure(err) || errors.Is(err, ErrTokParsingError)
+}
+
+// PushBatch pushes messages in chunks, see SetBatchLimits, returning a result for each message.
+// Messages of a batch chunk the service rejects as a whole get the rejection as their item error,
+// so the returned error is set only if the batch couldn't be sent or its responses couldn't be read.
 func (pq *PriorityQueue) PushBatch(msgs ...*Message) ([]PushBatchItem, error) {
 	last := len(msgs) - 1
 	if last == -1 {
 		return nil, nil
 	}
+	ctx := msgs[0].context()
+	if err := pq.waitPushLimits(ctx, msgs...); err != nil {
+		return nil, err
+	}
+	// Payload slice is reused between batches to keep push path allocation free.
+	payloads := slices.Grow(pq.payloads[:0], len(msgs))[:len(msgs)]
+	defer func() {
+		clear(payloads)
+		pq.payloads = payloads[:0]
+	}()
+	items, err := pq.pushBatch(ctx, msgs, payloads)
+	if err == nil && pq.fullQueuePolicy != nil {
+		err = pq.fullQueuePolicy.pushBatch(ctx, pq, msgs, payloads, items)
+	}
+	pq.dropRejected(payloads, items, err)
+	return items, err
+}
+
+// pushBatch pushes messages with their encoded payloads. Empty payloads are encoded
+// and stored into payloads, so retries send the same encoded payloads.
+func (pq *PriorityQueue) pushBatch(ctx context.Context, msgs []*Message, payloads []string) ([]PushBatchItem, error) {
+	var items []PushBatchItem
+	err := pq.call(ctx, cmdPushBatch, func(spanCtx context.Context) error {
+		for i, msg := range msgs {
+			if payloads[i] != "" {
+				continue
+			}
+			p, err := pq.payload(msg, traceContext(msg, ctx, spanCtx))
+			if err != nil {
+				// Nothing has been sent yet.
+				pq.dropPayloads(payloads[:i])
+				return err
+			}
+			payloads[i] = p
+		}
+
+		items = make([]PushBatchItem, 0, len(msgs))
+		// Chunks are pipelined: the next chunk is sent before the response to
+		// the previous one is read, keeping a bounded number of responses in flight.
+		var inFlight [batchPipelineDepth]int
+		sent, acked, start := 0, 0, 0
+		for start < len(msgs) || acked < sent {
+			if start < len(msgs) && sent-acked < batchPipelineDepth {
+				end := pq.batchChunkEnd(msgs, payloads, start)
+				pq.writeBatch(msgs[start:end], payloads[start:end])
+				if err := pq.bufWriter.Flush(); err != nil {
+					// Chunk is incomplete, so the service hasn't executed it.
+					pq.dropPayloads(payloads[start:])
+					return err
+				}
+				inFlight[sent%batchPipelineDepth] = end - start
+				sent++
+				start = end
+				continue
+			}
+			size := inFlight[acked%batchPipelineDepth]
+			acked++
+			before := len(items)
+			res, err := pq.handleBatchResponse(items)
+			if isRejected(err) {
+				// A rejected chunk fails only its own messages.
+				for i := 0; i < size; i++ {
+					items = append(items, PushBatchItem{Error: err})
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if len(res)-before != size {
+				return WrongMessageFormatError("Batch response size doesn't match the batch")
+			}
+			items = res
+		}
+
+		size := 0
+		for i, item := range items {
+			if item.Error == nil && i < len(msgs) {
+				size += len(msgs[i].payload)
+			}
+		}
+		pq.metrics.PayloadBytesOut(pq.queueName, size)
+		return nil
+	})
+	return items, err
+}
+
+func (pq *PriorityQueue) writeBatch(msgs []*Message, payloads []string) {
 	pushCmd := cmdPushBatch
 	for i, msg := range msgs {
-		WriteData(pq.bufWriter, pushCmd, msg.encode())
-		if i != last {
+		if i > 0 {
 			pq.bufWriter.WriteByte(' ')
 		}
+		pq.bufWriter.WriteString(pushCmd)
+		msg.writeTo(pq.bufWriter, payloads[i])
 		pushCmd = cmdBatchNext
 	}
-	err := CompleteWrite(pq.bufWriter)
-	if err != nil {
-		return nil, err
+	pq.bufWriter.WriteByte('\n')
+}
+
+// batchChunkEnd returns the end of a batch chunk starting at start. A chunk has
+// at least one message even if it exceeds the max bytes limit.
+func (pq *PriorityQueue) batchChunkEnd(msgs []*Message, payloads []string, start int) int {
+	end, size := start, 0
+	for end < len(msgs) {
+		if pq.batchMaxCount > 0 && end-start >= pq.batchMaxCount {
+			break
+		}
+		n := msgs[end].encodedSize(payloads[end])
+		if pq.batchMaxBytes > 0 && end > start && size+n > pq.batchMaxBytes {
+			break
+		}
+		size += n
+		end++
 	}
-	return pq.handleBatchResponse()
+	return end
 }
 
 func (pq *PriorityQueue) Push(msg *Message) error {
-	if err := SendCommand(pq.bufWriter, cmdPush, msg.encode()...); err != nil {
+	if err := pq.waitPushLimits(msg.context(), msg); err != nil {
 		return err
 	}
-	return HandleOk(pq.tokReader)
+	var payload string
+	err := pq.push(msg, &payload)
+	if pq.fullQueuePolicy != nil && IsQueueFull(err) {
+		err = pq.fullQueuePolicy.push(pq, msg, &payload)
+	}
+	if isRejected(err) {
+		pq.dropPayload(&payload)
+	}
+	return err
 }
 
-// Pop pops available from the queue completely removing them.
-func (pq *PriorityQueue) Pop(opts *popOptions) ([]*QueueMessage, error) {
-	if err := SendCommand(pq.bufWriter, cmdPop, opts.makeRequest()...); err != nil {
-		return nil, err
-	}
+// push pushes a message with its encoded payload. Empty payload is encoded and
+// stored into payload, so retries send the same encoded payload.
+func (pq *PriorityQueue) push(msg *Message, payload *string) error {
+	return pq.call(msg.context(), cmdPush, func(ctx context.Context) error {
+		if *payload == "" {
+			p, err := pq.payload(msg, ctx)
+			if err != nil {
+				return err
+			}
+			*payload = p
+		}
+		pq.bufWriter.WriteString(cmdPush)
+		msg.writeTo(pq.bufWriter, *payload)
+		if err := CompleteWrite(pq.bufWriter); err != nil {
+			// Command is incomplete, so the service hasn't executed it.
+			pq.dropPayload(payload)
+			return err
+		}
+		if err := HandleOk(pq.tokReader); err != nil {
+			return err
+		}
+		pq.metrics.PayloadBytesOut(pq.queueName, len(msg.payload))
+		return nil
+	})
+}
 
-	return pq.handleMessages()
+// Pop pops available from the queue completely removing them.
+func (pq *PriorityQueue) Pop(opts *PopOptions) ([]*QueueMessage, error) {
+	return pq.popMessages(opts.context(), cmdPop, opts.expectedCount(), opts, true)
 }
 
 // PopLock pops available from the queue locking them.
-func (pq *PriorityQueue) PopLock(opts *popLockOptions) ([]*QueueMessage, error) {
-	if err := SendCommand(pq.bufWriter, cmdPopLock, opts.makeRequest()...); err != nil {
-		return nil, err
-	}
+func (pq *PriorityQueue) PopLock(opts *PopLockOptions) ([]*QueueMessage, error) {
+	return pq.popMessages(opts.context(), cmdPopLock, opts.expectedCount(), opts, opts == nil || !opts.raw)
+}
+
+// batchPipelineDepth is the max number of batch chunks sent without reading their responses.
+const batchPipelineDepth = 2
 
-	return pq.handleMessages()
+// requestWriter writes command parameters into the connection buffer.
+type requestWriter interface {
+	writeTo(w *bufio.Writer)
 }
 
-func (pq *PriorityQueue) DeleteById(id string) error {
-	if err := SendCommand(pq.bufWriter, cmdDeleteById, EncodeString(id)); err != nil {
+func (pq *PriorityQueue) popMessages(ctx context.Context, cmd string, limit int, args requestWriter,
+	decode bool) ([]*QueueMessage, error) {
+	var msgs []*QueueMessage
+	err := pq.popStream(ctx, cmd, limit, args, decode, func(msg *QueueMessage) error {
+		msgs = append(msgs, msg)
+		return nil
+	})
+	return msgs, err
+}
+
+// PopFunc pops messages like Pop calling f for every message as soon as it is decoded
+// instead of building the whole response first. If f returns an error, the rest of
+// the response is discarded and the error is returned. f must not use the queue.
+func (pq *PriorityQueue) PopFunc(opts *PopOptions, f func(*QueueMessage) error) error {
+	return pq.popStream(opts.context(), cmdPop, opts.expectedCount(), opts, true, f)
+}
+
+// PopLockFunc pops and locks messages like PopLock calling f for every message as soon as
+// it is decoded. If f returns an error, the rest of the response is discarded and the error
+// is returned, discarded messages stay locked until the lock timeout. f must not use the queue.
+func (pq *PriorityQueue) PopLockFunc(opts *PopLockOptions, f func(*QueueMessage) error) error {
+	return pq.popStream(opts.context(), cmdPopLock, opts.expectedCount(), opts, true, f)
+}
+
+// popStream pops messages calling f for each of them. Payload encodings are left
+// as they are if decode is false.
+func (pq *PriorityQueue) popStream(ctx context.Context, cmd string, limit int, args requestWriter,
+	decode bool, f func(*QueueMessage) error) error {
+	if pq.popLimiter != nil {
+		if err := pq.popLimiter.Wait(ctx, limit); err != nil {
+			return err
+		}
+	}
+	count, size := 0, 0
+	var cbErr error
+	deliver := func(msg *QueueMessage) error {
+		if decode {
+			pq.decodePayload(msg)
+		}
+		pq.extractMessageContext(msg)
+		count++
+		size += len(msg.Payload)
+		cbErr = f(msg)
+		return cbErr
+	}
+	err := pq.call(ctx, cmd, func(context.Context) error {
+		pq.bufWriter.WriteString(cmd)
+		args.writeTo(pq.bufWriter)
+		if err := CompleteWrite(pq.bufWriter); err != nil {
+			return err
+		}
+		var err error
+		if ts, ok := pq.tokReader.(ITokenStream); ok {
+			err = pq.readMessages(ts, deliver)
+		} else {
+			var msgs []*QueueMessage
+			msgs, err = pq.handleMessages()
+			for i := 0; i < len(msgs) && err == nil; i++ {
+				err = deliver(msgs[i])
+			}
+		}
+		pq.metrics.MessagesPopped(pq.queueName, cmd, count)
+		pq.metrics.PayloadBytesIn(pq.queueName, size)
+		if err == cbErr {
+			// Callback errors don't mean the command has failed.
+			return nil
+		}
 		return err
+	})
+	if pq.popLimiter != nil {
+		pq.popLimiter.Return(limit - count)
+	}
+	if err == nil {
+		err = cbErr
 	}
-	return HandleOk(pq.tokReader)
+	return err
+}
+
+func (pq *PriorityQueue) DeleteById(id string) error {
+	return pq.sendIdCommand(cmdDeleteById, id)
 }
 
 func (pq *PriorityQueue) DeleteLockedById(id string) error {
-	if err := SendCommand(pq.bufWriter, cmdDeleteLockedById, EncodeString(id)); err != nil {
-		return err
+	err := pq.sendIdCommand(cmdDeleteLockedById, id)
+	if err == nil {
+		pq.releaseBlobById(id, true)
 	}
-	return HandleOk(pq.tokReader)
+	return err
 }
 
 func (pq *PriorityQueue) DeleteByReceipt(rcpt string) error {
-	if err := SendCommand(pq.bufWriter, cmdDeleteByReceipt, EncodeString(rcpt)); err != nil {
-		return err
+	err := pq.sendIdCommand(cmdDeleteByReceipt, rcpt)
+	if err == nil {
+		pq.releaseBlob(rcpt, true)
 	}
-	return HandleOk(pq.tokReader)
+	return err
 }
 
 func (pq *PriorityQueue) UnlockById(id string) error {
-	if err := SendCommand(pq.bufWriter, cmdUnlockById, EncodeString(id)); err != nil {
-		return err
+	err := pq.sendIdCommand(cmdUnlockById, id)
+	if err == nil {
+		pq.releaseBlobById(id, false)
 	}
-	return HandleOk(pq.tokReader)
+	return err
 }
 
 func (pq *PriorityQueue) UnlockByReceipt(rcpt string) error {
-	if err := SendCommand(pq.bufWriter, cmdUnlockByReceipt, EncodeString(rcpt)); err != nil {
-		return err
+	err := pq.sendIdCommand(cmdUnlockByReceipt, rcpt)
+	if err == nil {
+		pq.releaseBlob(rcpt, false)
 	}
-	return HandleOk(pq.tokReader)
+	return err
+}
+
+// sendIdCommand sends a command which takes a single message id or receipt and expects +OK.
+func (pq *PriorityQueue) sendIdCommand(cmd, id string) error {
+	return pq.call(context.Background(), cmd, func(context.Context) error {
+		pq.bufWriter.WriteString(cmd)
+		WriteStringArg(pq.bufWriter, id)
+		if err := CompleteWrite(pq.bufWriter); err != nil {
+			return err
+		}
+		return HandleOk(pq.tokReader)
+	})
 }
 
 func (pq *PriorityQueue) SetParams(params *PqParams) error {
-	if err := SendCommand(pq.bufWriter, cmdSetCfg, params.makeRequest()...); err != nil {
-		return err
-	}
-	return HandleOk(pq.tokReader)
+	return pq.call(context.Background(), cmdSetCfg, func(context.Context) error {
+		pq.bufWriter.WriteString(cmdSetCfg)
+		params.writeTo(pq.bufWriter)
+		if err := CompleteWrite(pq.bufWriter); err != nil {
+			return err
+		}
+		return HandleOk(pq.tokReader)
+	})
 }
 
 func (pq *PriorityQueue) handleMessages() ([]*QueueMessage, error) {
+	if ts, ok := pq.tokReader.(ITokenStream); ok {
+		var msgs []*QueueMessage
+		err := pq.readMessages(ts, func(msg *QueueMessage) error {
+			msgs = append(msgs, msg)
+			return nil
+		})
+		return msgs, err
+	}
+
 	tokens, err := pq.tokReader.ReadTokens()
 
 	if err != nil {
 		return nil, err
 	}
 
-	if tokens[0] == "+MSGS" {
+	if len(tokens) > 0 && tokens[0] == "+MSGS" {
 		return parsePoppedMessages(tokens[1:])
 	}
 
@@ -181,7 +529,30 @@ func (pq *PriorityQueue) handleMessages() ([]*QueueMessage, error) {
 	return nil, UnexpectedResponse(tokens)
 }
 
-func (pq *PriorityQueue) handleBatchResponse() ([]PushBatchItem, error) {
+// readMessages reads POP response without materializing the whole token list.
+func (pq *PriorityQueue) readMessages(ts ITokenStream, f func(*QueueMessage) error) error {
+	t, last, err := ts.ReadToken()
+	if err != nil {
+		return err
+	}
+	if t == "+MSGS" && !last {
+		return readPoppedMessages(ts, f)
+	}
+	tokens := []string{t}
+	for !last {
+		if t, last, err = ts.ReadToken(); err != nil {
+			return err
+		}
+		tokens = append(tokens, t)
+	}
+	if err := ParseError(tokens); err != nil {
+		return err
+	}
+	return UnexpectedResponse(tokens)
+}
+
+// handleBatchResponse reads batch response appending its items to items.
+func (pq *PriorityQueue) handleBatchResponse(items []PushBatchItem) ([]PushBatchItem, error) {
 	tokens, err := pq.tokReader.ReadTokens()
 	if err != nil {
 		return nil, err
@@ -197,7 +568,7 @@ func (pq *PriorityQueue) handleBatchResponse() ([]PushBatchItem, error) {
 		if size < 0 {
 			return nil, UnexpectedResponse(tokens)
 		}
-		return pq.parseBatchResponse(int(size))
+		return pq.parseBatchResponse(items, int(size))
 
 	}
 	if err := ParseError(tokens); err != nil {
@@ -207,8 +578,8 @@ func (pq *PriorityQueue) handleBatchResponse() ([]PushBatchItem, error) {
 	return nil, UnexpectedResponse(tokens)
 }
 
-func (pq *PriorityQueue) parseBatchResponse(size int) ([]PushBatchItem, error) {
-	respItems := make([]PushBatchItem, 0, size)
+func (pq *PriorityQueue) parseBatchResponse(respItems []PushBatchItem, size int) ([]PushBatchItem, error) {
+	size += len(respItems)
 	var id string
 	for len(respItems) < size {
 		tokens, err := pq.tokReader.ReadTokens()
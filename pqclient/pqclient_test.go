@@ -0,0 +1,210 @@
+package pqclient
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	. "github.com/vburenin/firempq_connector/fmpq_err"
+	. "github.com/vburenin/firempq_connector/metrics"
+	. "github.com/vburenin/firempq_connector/parsers"
+)
+
+// repeatReader returns the same response forever.
+type repeatReader struct {
+	resp string
+	pos  int
+}
+
+func (r *repeatReader) Read(b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		c := copy(b[n:], r.resp[r.pos:])
+		n += c
+		r.pos = (r.pos + c) % len(r.resp)
+	}
+	return n, nil
+}
+
+// benchQueue returns a queue discarding commands and reading resp as a response to each of them.
+func benchQueue(resp string) *PriorityQueue {
+	return &PriorityQueue{
+		queueName: "bench",
+		bufWriter: bufio.NewWriter(io.Discard),
+		tokReader: NewTokenReader(readerConn{r: &repeatReader{resp: resp}}),
+		metrics:   NopMetrics{},
+	}
+}
+
+// testQueue returns a queue reading responses from resp and writing commands into the returned buffer.
+func testQueue(resp string) (*PriorityQueue, *bytes.Buffer) {
+	var out bytes.Buffer
+	return &PriorityQueue{
+		queueName: "test",
+		bufWriter: bufio.NewWriter(&out),
+		tokReader: NewTokenReader(readerConn{r: strings.NewReader(resp)}),
+		metrics:   NopMetrics{},
+	}, &out
+}
+
+// pushedPayload returns the payload of a PUSH command without message id.
+func pushedPayload(t *testing.T, cmd string) string {
+	t.Helper()
+	cmd, ok := strings.CutPrefix(cmd, "PUSH PL $")
+	if !ok {
+		t.Fatalf("Unexpected push command %q", cmd)
+	}
+	_, payload, _ := strings.Cut(strings.TrimSuffix(cmd, "\n"), " ")
+	return payload
+}
+
+func BenchmarkPush(b *testing.B) {
+	pq := benchQueue("+OK\n")
+	msg := NewMessage(strings.Repeat("x", 256)).SetId("msg-1").SetTtl(60000)
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := pq.Push(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPushBatch allocates only the returned items, message ids and the batch size token.
+func BenchmarkPushBatch(b *testing.B) {
+	const size = 10
+	resp := "+BATCH *" + strconv.Itoa(size) + "\n" + strings.Repeat("+MSG id\n", size)
+	pq := benchQueue(resp)
+	msgs := make([]*Message, size)
+	for i := range msgs {
+		msgs[i] = NewMessage(strings.Repeat("x", 256)).SetTtl(60000)
+	}
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := pq.PushBatch(msgs...); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// readHook calls onRead before the first read from r.
+type readHook struct {
+	r      io.Reader
+	onRead func()
+}
+
+func (h *readHook) Read(b []byte) (int, error) {
+	if h.onRead != nil {
+		h.onRead()
+		h.onRead = nil
+	}
+	return h.r.Read(b)
+}
+
+func batchMessages(payloads ...string) []*Message {
+	msgs := make([]*Message, len(payloads))
+	for i, p := range payloads {
+		msgs[i] = NewMessage(p).SetId(string(rune('a' + i)))
+	}
+	return msgs
+}
+
+// chunkSizes returns the number of messages in each PUSHB command line.
+func chunkSizes(cmds string) []int {
+	var sizes []int
+	for _, line := range strings.Split(strings.TrimSuffix(cmds, "\n"), "\n") {
+		sizes = append(sizes, strings.Count(line, " NXT ")+1)
+	}
+	return sizes
+}
+
+func expectItems(t *testing.T, items []PushBatchItem, ids ...string) {
+	t.Helper()
+	if len(items) != len(ids) {
+		t.Fatalf("Got %d items, want %d", len(items), len(ids))
+	}
+	for i, id := range ids {
+		if items[i].MsgID != id || (id == "") != (items[i].Error != nil) {
+			t.Fatalf("Item %d is %+v, want id %q", i, items[i], id)
+		}
+	}
+}
+
+func TestPushBatchChunksByCount(t *testing.T) {
+	pq, out := testQueue("+BATCH *2\n+MSG a\n+MSG b\n" +
+		"+BATCH *2\n+MSG c\n-ERR 409 $3 dup\n" +
+		"+BATCH *1\n+MSG e\n")
+	pq.SetBatchLimits(2, 0)
+	items, err := pq.PushBatch(batchMessages("1", "2", "3", "4", "5")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectItems(t, items, "a", "b", "c", "", "e")
+	if !IsIdConflict(items[3].Error) {
+		t.Fatalf("Got %v, want id conflict", items[3].Error)
+	}
+	if sizes := chunkSizes(out.String()); !slices.Equal(sizes, []int{2, 2, 1}) {
+		t.Fatalf("Got chunks %v", sizes)
+	}
+}
+
+func TestPushBatchChunksByBytes(t *testing.T) {
+	pq, out := testQueue("+BATCH *2\n+MSG a\n+MSG b\n+BATCH *1\n+MSG c\n+BATCH *1\n+MSG d\n")
+	// Each message takes 64 bytes besides its id and payload.
+	pq.SetBatchLimits(0, 200)
+	small, large := strings.Repeat("s", 20), strings.Repeat("l", 300)
+	items, err := pq.PushBatch(batchMessages(small, small, large, small)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectItems(t, items, "a", "b", "c", "d")
+	if sizes := chunkSizes(out.String()); !slices.Equal(sizes, []int{2, 1, 1}) {
+		t.Fatalf("Got chunks %v", sizes)
+	}
+}
+
+func TestPushBatchPipelinesChunks(t *testing.T) {
+	var out bytes.Buffer
+	sentBeforeRead := 0
+	pq := &PriorityQueue{
+		queueName: "test",
+		bufWriter: bufio.NewWriter(&out),
+		tokReader: NewTokenReader(readerConn{r: &readHook{
+			r:      strings.NewReader(strings.Repeat("+BATCH *1\n+MSG id\n", 4)),
+			onRead: func() { sentBeforeRead = strings.Count(out.String(), "\n") },
+		}}),
+		metrics: NopMetrics{},
+	}
+	pq.SetBatchLimits(1, 0)
+	items, err := pq.PushBatch(batchMessages("1", "2", "3", "4")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectItems(t, items, "id", "id", "id", "id")
+	if sentBeforeRead != batchPipelineDepth {
+		t.Fatalf("%d chunks sent before reading the first response, want %d", sentBeforeRead, batchPipelineDepth)
+	}
+}
+
+func TestPushBatchRejectedChunks(t *testing.T) {
+	pq, _ := testQueue("-ERR 400 $11 Bad request\n")
+	items, err := pq.PushBatch(batchMessages("1", "2")...)
+	if err != nil {
+		t.Fatalf("Single chunk rejection returned %v", err)
+	}
+	expectItems(t, items, "", "")
+
+	pq, _ = testQueue("+BATCH *1\n+MSG a\n-ERR 400 $11 Bad request\n")
+	pq.SetBatchLimits(1, 0)
+	items, err = pq.PushBatch(batchMessages("1", "2")...)
+	if err != nil {
+		t.Fatalf("Chunk rejection returned %v", err)
+	}
+	expectItems(t, items, "a", "")
+	if e, ok := items[1].Error.(*FireMpqError); !ok || e.Code != 400 {
+		t.Fatalf("Got %v, want the rejection", items[1].Error)
+	}
+}
@@ -1,8 +1,13 @@
 package pqclient
 
 import (
-	. "github.com/vburenin/firempq_connector/encoders"
+	"bufio"
+	"context"
+	"strconv"
+
+	. "github.com/vburenin/firempq_connector/api"
 	. "github.com/vburenin/firempq_connector/fmpq_err"
+	. "github.com/vburenin/firempq_connector/netutils"
 	. "github.com/vburenin/firempq_connector/parsers"
 )
 
@@ -25,6 +30,10 @@ type Message struct {
 	ttl      int64
 	syncWait bool
 	async    bool
+	ctx      context.Context
+	headers  map[string]string
+	// raw means payload is already encoded and is sent as is.
+	raw bool
 }
 
 func NewMessage(payload string) *Message {
@@ -43,6 +52,8 @@ func (msg *Message) SetId(id string) *Message {
 	return msg
 }
 
+// SetPriority sets message priority, lower values are popped first. It is simulated by
+// MemoryQueue only, PriorityQueue doesn't send it to the service.
 func (msg *Message) SetPriority(priority int64) *Message {
 	msg.priority = priority
 	return msg
@@ -68,31 +79,61 @@ func (msg *Message) SetAsync(b bool) *Message {
 	return msg
 }
 
-func (msg *Message) encodeTo(data [][]byte) [][]byte {
+// SetHeader sets a message header such as content type, producer name or correlation id.
+// Headers are stored in an envelope inside the message payload.
+func (msg *Message) SetHeader(key, value string) *Message {
+	if msg.headers == nil {
+		msg.headers = make(map[string]string, 4)
+	}
+	msg.headers[key] = value
+	return msg
+}
+
+// SetHeaders sets all message headers at once replacing previously set headers.
+func (msg *Message) SetHeaders(headers map[string]string) *Message {
+	msg.headers = headers
+	return msg
+}
+
+// SetContext sets a context of the message. If client has a tracer configured, the push
+// command span is started in ctx and its trace context is injected into the message payload envelope.
+func (msg *Message) SetContext(ctx context.Context) *Message {
+	msg.ctx = ctx
+	return msg
+}
+
+func (msg *Message) context() context.Context {
+	if msg.ctx == nil {
+		return context.Background()
+	}
+	return msg.ctx
+}
+
+// writeTo writes message parameters directly into the connection buffer.
+func (msg *Message) writeTo(w *bufio.Writer, payload string) {
 	if msg.id != "" {
-		data = append(data, prmId)
-		data = append(data, EncodeString(msg.id))
+		WriteArg(w, prmId)
+		WriteStringArg(w, msg.id)
 	}
 	if msg.delay >= 0 {
-		data = append(data, prmDelay)
-		data = append(data, EncodeInt64(msg.delay))
+		WriteArg(w, prmDelay)
+		WriteIntArg(w, msg.delay)
 	}
 	if msg.ttl >= 0 {
-		data = append(data, prmMsgTtl)
-		data = append(data, EncodeInt64(msg.ttl))
+		WriteArg(w, prmMsgTtl)
+		WriteIntArg(w, msg.ttl)
 	}
 	if msg.syncWait {
-		data = append(data, prmSyncWait)
+		WriteArg(w, prmSyncWait)
 	}
-
-	data = append(data, prmPayload)
-	data = append(data, EncodeString(msg.payload))
-	return data
+	WriteArg(w, prmPayload)
+	WriteStringArg(w, payload)
 }
 
-func (msg *Message) encode() [][]byte {
-	data := make([][]byte, 0, 2)
-	return msg.encodeTo(data)
+// encodedSize returns an upper bound of the encoded message size within a batch.
+func (msg *Message) encodedSize(payload string) int {
+	// Command name, parameter names, separators and integers fit into the constant.
+	return 64 + len(msg.id) + len(payload)
 }
 
 type QueueMessage struct {
@@ -102,31 +143,58 @@ type QueueMessage struct {
 	ExpireTs int64
 	UnlockTs int64
 	PopCount int64
+	// Headers are nil for messages pushed without headers.
+	Headers map[string]string
+	// Error is set if message payload couldn't be decoded, Payload is left as is in this case.
+	Error     error
+	ctx       context.Context
+	encodings []string
+	// raw is the payload as it has been received from the service.
+	raw string
+}
+
+// Context returns a context carrying trace context extracted from the message.
+func (qm *QueueMessage) Context() context.Context {
+	if qm.ctx == nil {
+		return context.Background()
+	}
+	return qm.ctx
+}
+
+// rawMessage returns a message pushing popped message payload exactly as it has been received,
+// keeping its envelope, headers and encodings, so it doesn't need to be decodable.
+func rawMessage(qm *QueueMessage) *Message {
+	msg := NewMessage(qm.raw).SetId(qm.Id)
+	msg.raw = true
+	return msg
 }
 
 func parsePoppedMessages(tokens []string) ([]*QueueMessage, error) {
 	if len(tokens) == 0 {
-		WrongMessageFormatError("No array header")
+		return nil, WrongMessageFormatError("No array header")
 	}
 	arraySize, err := ParseArraySize(tokens[0])
-	msgs := make([]*QueueMessage, 0, arraySize)
 	if err != nil {
 		return nil, err
 	}
 	tokens = tokens[1:]
-	for i := arraySize; i > 0; i-- {
+	if arraySize > int64(len(tokens)) {
+		return nil, messageFormatError(0, "array with messages ends unexpectedly")
+	}
+	msgs := make([]*QueueMessage, 0, arraySize)
+	for i := int64(0); i < arraySize; i++ {
 		if len(tokens) == 0 {
-			WrongMessageFormatError("Array with messages ends unexpectedly")
+			return nil, messageFormatError(i, "array with messages ends unexpectedly")
 		}
 		keysCount, err := ParseMapSize(tokens[0])
 		if err != nil {
 			return nil, err
 		}
 		tokens = tokens[1:]
-		tokensNeeded := keysCount << 1
-		if int64(len(tokens)) < tokensNeeded {
-			return nil, WrongMessageFormatError("Message data ends unexpectedly")
+		if keysCount > int64(len(tokens))/2 {
+			return nil, messageFormatError(i, "message data ends unexpectedly")
 		}
+		tokensNeeded := keysCount << 1
 		msg, err := parseMessage(tokens[:tokensNeeded])
 		if err != nil {
 			return nil, err
@@ -134,34 +202,111 @@ func parsePoppedMessages(tokens []string) ([]*QueueMessage, error) {
 		tokens = tokens[tokensNeeded:]
 		msgs = append(msgs, msg)
 	}
+	if len(tokens) > 0 {
+		return nil, messageFormatError(arraySize, "unexpected data after messages")
+	}
 	return msgs, nil
 }
 
+// messageFormatError returns an error pointing at a message of POP response.
+func messageFormatError(idx int64, desc string) error {
+	return WrongMessageFormatError("Message " + strconv.FormatInt(idx, 10) + ": " + desc)
+}
+
 func parseMessage(tokens []string) (*QueueMessage, error) {
 	msg := QueueMessage{}
-	var err error
-
 	idx := len(tokens) - 2
 	for idx >= 0 {
-		switch tokens[idx] {
-		case "ID":
-			msg.Id = tokens[idx+1]
-		case "PL":
-			msg.Payload = tokens[idx+1]
-		case "RCPT":
-			msg.Receipt = tokens[idx+1]
-		case "UTS":
-			msg.UnlockTs, err = ParseInt(tokens[idx+1])
-		case "ETS":
-			msg.ExpireTs, err = ParseInt(tokens[idx+1])
-		case "POPCNT":
-			msg.PopCount, err = ParseInt(tokens[idx+1])
-		default:
-		}
-		if err != nil {
+		if err := msg.setField(tokens[idx], tokens[idx+1]); err != nil {
 			return nil, err
 		}
 		idx -= 2
 	}
+	unwrapEnvelope(&msg)
 	return &msg, nil
 }
+
+func (msg *QueueMessage) setField(key, value string) error {
+	var err error
+	switch key {
+	case "ID":
+		msg.Id = value
+	case "PL":
+		msg.Payload = value
+	case "RCPT":
+		msg.Receipt = value
+	case "UTS":
+		msg.UnlockTs, err = ParseInt(value)
+	case "ETS":
+		msg.ExpireTs, err = ParseInt(value)
+	case "POPCNT":
+		msg.PopCount, err = ParseInt(value)
+	default:
+	}
+	return err
+}
+
+// readPoppedMessages decodes +MSGS response token by token calling f for every message
+// as soon as it is decoded. If decoding fails, the rest of the response is skipped.
+func readPoppedMessages(ts ITokenStream, f func(*QueueMessage) error) error {
+	var readErr error
+	last := false
+	next := func() string {
+		if last || readErr != nil {
+			return ""
+		}
+		var t string
+		t, last, readErr = ts.ReadToken()
+		return t
+	}
+	fail := func(err error) error {
+		for !last && readErr == nil {
+			next()
+		}
+		if readErr != nil {
+			return readErr
+		}
+		return err
+	}
+
+	t := next()
+	if readErr != nil {
+		return readErr
+	}
+	if t == "" {
+		return fail(WrongMessageFormatError("No array header"))
+	}
+	arraySize, err := ParseArraySize(t)
+	if err != nil {
+		return fail(err)
+	}
+	for i := int64(0); i < arraySize; i++ {
+		t = next()
+		if t == "" {
+			return fail(messageFormatError(i, "array with messages ends unexpectedly"))
+		}
+		keysCount, err := ParseMapSize(t)
+		if err != nil {
+			return fail(err)
+		}
+		msg := &QueueMessage{}
+		for k := keysCount; k > 0; k-- {
+			key := next()
+			value := next()
+			if value == "" {
+				return fail(messageFormatError(i, "message data ends unexpectedly"))
+			}
+			if err := msg.setField(key, value); err != nil {
+				return fail(err)
+			}
+		}
+		unwrapEnvelope(msg)
+		if err := f(msg); err != nil {
+			return fail(err)
+		}
+	}
+	if !last {
+		return fail(messageFormatError(arraySize, "unexpected data after messages"))
+	}
+	return nil
+}
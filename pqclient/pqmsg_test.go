@@ -0,0 +1,68 @@
+package pqclient
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	. "github.com/vburenin/firempq_connector/parsers"
+)
+
+// readerConn is a connection reading service responses from r.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readerConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+var poppedMessagesSeeds = []string{
+	"*0",
+	"*1 %3 ID a PL $5 hello POPCNT :1",
+	"*2 %2 ID a RCPT r1 %4 ID b PL $4 data UTS :100 ETS :200",
+	"*1 %1 PL $2 {}",
+	"*2 %1 ID a",
+	"*1 %2 ID a POPCNT x",
+	"*-1",
+	"*1 %-1",
+}
+
+func FuzzParsePoppedMessages(f *testing.F) {
+	for _, s := range poppedMessagesSeeds {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, data string) {
+		tokens := strings.Fields(data)
+		msgs, err := parsePoppedMessages(tokens)
+		if err != nil {
+			return
+		}
+		if size, _ := ParseArraySize(tokens[0]); int64(len(msgs)) != size {
+			t.Fatalf("%d messages parsed from array of %d", len(msgs), size)
+		}
+	})
+}
+
+func FuzzReadPoppedMessages(f *testing.F) {
+	for _, s := range poppedMessagesSeeds {
+		f.Add(s + "\n+OK\n")
+	}
+	f.Fuzz(func(t *testing.T, data string) {
+		tok := NewTokenReader(readerConn{r: strings.NewReader(data)})
+		var msgs []*QueueMessage
+		err := readPoppedMessages(tok, func(msg *QueueMessage) error {
+			msgs = append(msgs, msg)
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		header, _, _ := NewTokenReader(readerConn{r: strings.NewReader(data)}).ReadToken()
+		if size, _ := ParseArraySize(header); int64(len(msgs)) != size {
+			t.Fatalf("%d messages read from array of %d", len(msgs), size)
+		}
+	})
+}
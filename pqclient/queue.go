@@ -0,0 +1,32 @@
+package pqclient
+
+// Producer pushes messages into a queue.
+type Producer interface {
+	Push(msg *Message) error
+	PushBatch(msgs ...*Message) ([]PushBatchItem, error)
+}
+
+// Consumer pops messages from a queue and acknowledges them.
+type Consumer interface {
+	Pop(opts *PopOptions) ([]*QueueMessage, error)
+	PopLock(opts *PopLockOptions) ([]*QueueMessage, error)
+	DeleteById(id string) error
+	DeleteLockedById(id string) error
+	DeleteByReceipt(rcpt string) error
+	UnlockById(id string) error
+	UnlockByReceipt(rcpt string) error
+}
+
+// Queue is implemented by PriorityQueue and MemoryQueue, so applications can
+// use MemoryQueue in their tests instead of a real service.
+type Queue interface {
+	Producer
+	Consumer
+	GetName() string
+	SetParams(params *PqParams) error
+}
+
+var (
+	_ Queue = (*PriorityQueue)(nil)
+	_ Queue = (*MemoryQueue)(nil)
+)
@@ -0,0 +1,130 @@
+package pqclient
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"strconv"
+)
+
+// HeaderRetryAttempt is a message header holding the number of times message has been retried.
+const HeaderRetryAttempt = "retry-attempt"
+
+var ErrRetriesExhausted = errors.New("Max retry attempts exhausted")
+
+// RetryPolicy defines exponential backoff for failed message processing.
+type RetryPolicy struct {
+	initialDelay int64
+	maxDelay     int64
+	multiplier   float64
+	jitter       float64
+	maxAttempts  int64
+}
+
+// NewRetryPolicy returns a policy retrying 5 times starting with 1 second delay
+// doubling it each time up to 5 minutes with 20% jitter.
+func NewRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		initialDelay: 1000,
+		maxDelay:     300000,
+		multiplier:   2,
+		jitter:       0.2,
+		maxAttempts:  5,
+	}
+}
+
+// SetInitialDelay sets delay in milliseconds before the first retry. Value must be positive.
+func (p *RetryPolicy) SetInitialDelay(v int64) *RetryPolicy {
+	if v < 0 {
+		panic("Value must be positive")
+	}
+	p.initialDelay = v
+	return p
+}
+
+// SetMaxDelay sets upper bound of retry delay in milliseconds. Value must be positive.
+func (p *RetryPolicy) SetMaxDelay(v int64) *RetryPolicy {
+	if v < 0 {
+		panic("Value must be positive")
+	}
+	p.maxDelay = v
+	return p
+}
+
+// SetMultiplier sets delay growth factor applied after each attempt. Value must be at least 1.
+func (p *RetryPolicy) SetMultiplier(v float64) *RetryPolicy {
+	if v < 1 {
+		panic("Value must be at least 1")
+	}
+	p.multiplier = v
+	return p
+}
+
+// SetJitter sets random delay deviation as a fraction of the delay. Value must be in [0, 1] range.
+func (p *RetryPolicy) SetJitter(v float64) *RetryPolicy {
+	if v < 0 || v > 1 {
+		panic("Value must be in [0, 1] range")
+	}
+	p.jitter = v
+	return p
+}
+
+// SetMaxAttempts sets max number of retries. Value must be positive.
+func (p *RetryPolicy) SetMaxAttempts(v int64) *RetryPolicy {
+	if v < 0 {
+		panic("Value must be positive")
+	}
+	p.maxAttempts = v
+	return p
+}
+
+// Delay returns delay in milliseconds before retry attempt, attempts start from 1.
+func (p *RetryPolicy) Delay(attempt int64) int64 {
+	d := float64(p.initialDelay) * math.Pow(p.multiplier, float64(attempt-1))
+	if d > float64(p.maxDelay) {
+		d = float64(p.maxDelay)
+	}
+	if p.jitter > 0 {
+		d += d * p.jitter * (2*rand.Float64() - 1)
+	}
+	return int64(d)
+}
+
+// attempt returns the number of the next retry attempt of the message. Both retries done
+// by re-pushing the message and redeliveries of the same message are taken into account.
+func (p *RetryPolicy) attempt(msg *QueueMessage) int64 {
+	retried, _ := strconv.ParseInt(msg.Headers[HeaderRetryAttempt], 10, 64)
+	popCount := msg.PopCount
+	if popCount < 1 {
+		popCount = 1
+	}
+	return retried + popCount
+}
+
+// Retry pushes a copy of a locked message delayed according to the policy and
+// deletes the original message by its receipt. Returns ErrRetriesExhausted without
+// touching the message if it has been retried too many times already.
+func (pq *PriorityQueue) Retry(msg *QueueMessage, policy *RetryPolicy) error {
+	if msg.Error != nil {
+		return msg.Error
+	}
+	attempt := policy.attempt(msg)
+	if attempt > policy.maxAttempts {
+		return ErrRetriesExhausted
+	}
+
+	headers := make(map[string]string, len(msg.Headers)+1)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[HeaderRetryAttempt] = strconv.FormatInt(attempt, 10)
+
+	retry := NewMessage(msg.Payload).
+		SetHeaders(headers).
+		SetDelay(uint64(policy.Delay(attempt))).
+		SetContext(msg.Context())
+	if err := pq.Push(retry); err != nil {
+		return err
+	}
+	return pq.DeleteByReceipt(msg.Receipt)
+}
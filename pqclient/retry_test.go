@@ -0,0 +1,117 @@
+package pqclient
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  *RetryPolicy
+		attempt int64
+		want    int64
+	}{
+		{"first attempt", NewRetryPolicy().SetJitter(0), 1, 1000},
+		{"second attempt", NewRetryPolicy().SetJitter(0), 2, 2000},
+		{"fifth attempt", NewRetryPolicy().SetJitter(0), 5, 16000},
+		{"max delay", NewRetryPolicy().SetJitter(0).SetMaxDelay(5000), 4, 5000},
+		{"constant delay", NewRetryPolicy().SetJitter(0).SetMultiplier(1), 10, 1000},
+		{"multiplier", NewRetryPolicy().SetJitter(0).SetInitialDelay(100).SetMultiplier(1.5), 3, 225},
+		{"no delay", NewRetryPolicy().SetJitter(0).SetInitialDelay(0), 3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if d := tt.policy.Delay(tt.attempt); d != tt.want {
+				t.Fatalf("Got %d, want %d", d, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyJitter(t *testing.T) {
+	tests := []struct {
+		attempt  int64
+		min, max int64
+	}{
+		{1, 800, 1200},
+		{3, 3200, 4800},
+		{20, 240000, 360000},
+	}
+	p := NewRetryPolicy()
+	for _, tt := range tests {
+		lo, hi := tt.max, tt.min
+		for i := 0; i < 1000; i++ {
+			d := p.Delay(tt.attempt)
+			if d < tt.min || d > tt.max {
+				t.Fatalf("Attempt %d: delay %d is out of [%d, %d]", tt.attempt, d, tt.min, tt.max)
+			}
+			lo, hi = min(lo, d), max(hi, d)
+		}
+		if lo == hi {
+			t.Fatalf("Attempt %d: delay isn't randomized", tt.attempt)
+		}
+	}
+}
+
+func TestRetryPolicyAttempt(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *QueueMessage
+		want int64
+	}{
+		{"new message", &QueueMessage{}, 1},
+		{"redelivered", &QueueMessage{PopCount: 3}, 3},
+		{"retried", &QueueMessage{PopCount: 1, Headers: map[string]string{HeaderRetryAttempt: "2"}}, 3},
+		{"retried and redelivered", &QueueMessage{PopCount: 2, Headers: map[string]string{HeaderRetryAttempt: "2"}}, 4},
+		{"malformed header", &QueueMessage{PopCount: 1, Headers: map[string]string{HeaderRetryAttempt: "x"}}, 1},
+	}
+	p := NewRetryPolicy()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if a := p.attempt(tt.msg); a != tt.want {
+				t.Fatalf("Got %d, want %d", a, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	p := NewRetryPolicy().SetJitter(0).SetMaxAttempts(3)
+	tests := []struct {
+		name    string
+		retried string
+		err     error
+		cmds    string
+	}{
+		{"first retry", "", nil, "DELAY 1000 "},
+		{"last retry", "2", nil, "DELAY 4000 "},
+		{"exhausted", "3", ErrRetriesExhausted, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &QueueMessage{Id: "a", Payload: "payload", Receipt: "r1", PopCount: 1,
+				Headers: map[string]string{"k": "v"}}
+			if tt.retried != "" {
+				msg.Headers[HeaderRetryAttempt] = tt.retried
+			}
+			pq, out := testQueue("+OK\n+OK\n")
+			if err := pq.Retry(msg, p); err != tt.err {
+				t.Fatalf("Got %v, want %v", err, tt.err)
+			}
+			cmds := out.String()
+			if tt.err != nil {
+				if cmds != "" {
+					t.Fatalf("Unexpected commands %q", cmds)
+				}
+				return
+			}
+			if !strings.HasPrefix(cmds, "PUSH "+tt.cmds) || !strings.HasSuffix(cmds, "\nRDEL $2 r1\n") {
+				t.Fatalf("Unexpected commands %q", cmds)
+			}
+			if msg.Headers[HeaderRetryAttempt] != tt.retried {
+				t.Fatal("Retried message headers are modified")
+			}
+		})
+	}
+}
@@ -0,0 +1,336 @@
+package pqclient
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Message headers used by RPC calls.
+const (
+	HeaderCorrelationId = "correlation-id"
+	HeaderReplyTo       = "reply-to"
+	HeaderRpcError      = "rpc-error"
+)
+
+// rpcPollWait is a long polling wait timeout in milliseconds used to wait for requests and replies.
+const rpcPollWait = 1000
+
+var ErrRpcClientClosed = errors.New("RPC client is closed")
+
+// RemoteError is returned by RPCClient.Call if request handler failed.
+type RemoteError struct {
+	Msg string
+}
+
+func (e *RemoteError) Error() string {
+	return "Remote error: " + e.Msg
+}
+
+// RPCClient sends requests into a request queue and waits for replies on its private reply queue.
+// It is safe for concurrent use.
+type RPCClient struct {
+	pushLock sync.Mutex
+	requests *PriorityQueue
+	replies  *PriorityQueue
+
+	lock    sync.Mutex
+	waiters map[string]chan *QueueMessage
+	err     error
+	done    chan struct{}
+	closed  bool
+}
+
+// NewRPCClient creates an RPC client sending requests to requestQueue. It creates a private
+// reply queue which messages expire after replyTtl milliseconds. The reply queue is never
+// deleted, so long running services should reuse a named one, see NewRPCClientWithReplyQueue.
+func NewRPCClient(fmc *FireMpqClient, requestQueue string, replyTtl int64) (*RPCClient, error) {
+	requests, err := fmc.GetPQueue(requestQueue)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := fmc.CreatePQueue("rpc-reply-"+randomId(), NewPQueueOptions().SetMsgTtl(replyTtl))
+	if err != nil {
+		requests.Close()
+		return nil, err
+	}
+	return newRPCClient(requests, replies), nil
+}
+
+// NewRPCClientWithReplyQueue creates an RPC client sending requests to requestQueue and reading
+// replies from an existing replyQueue, so restarted processes don't leave reply queues behind.
+// Reply queue must not be used by any other client, replies of unknown calls are dropped.
+func NewRPCClientWithReplyQueue(fmc *FireMpqClient, requestQueue, replyQueue string) (*RPCClient, error) {
+	requests, err := fmc.GetPQueue(requestQueue)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := fmc.GetPQueue(replyQueue)
+	if err != nil {
+		requests.Close()
+		return nil, err
+	}
+	return newRPCClient(requests, replies), nil
+}
+
+func newRPCClient(requests, replies *PriorityQueue) *RPCClient {
+	c := &RPCClient{
+		requests: requests,
+		replies:  replies,
+		waiters:  make(map[string]chan *QueueMessage),
+		done:     make(chan struct{}),
+	}
+	go c.readReplies()
+	return c
+}
+
+// ReplyQueue returns the name of the private reply queue.
+func (c *RPCClient) ReplyQueue() string {
+	return c.replies.GetName()
+}
+
+// Call pushes request and waits for the reply until ctx is done. Remaining time of the ctx
+// deadline is used as a request TTL, so requests nobody waits for anymore expire.
+func (c *RPCClient) Call(ctx context.Context, req *Message) (*QueueMessage, error) {
+	corrId := randomId()
+	wait := make(chan *QueueMessage, 1)
+
+	c.lock.Lock()
+	if c.err != nil {
+		c.lock.Unlock()
+		return nil, c.err
+	}
+	c.waiters[corrId] = wait
+	c.lock.Unlock()
+
+	defer func() {
+		c.lock.Lock()
+		delete(c.waiters, corrId)
+		c.lock.Unlock()
+	}()
+
+	req.SetHeader(HeaderCorrelationId, corrId).SetHeader(HeaderReplyTo, c.replies.GetName())
+	req.SetContext(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		ttl := time.Until(deadline) / time.Millisecond
+		if ttl <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		req.SetTtl(uint64(ttl))
+	}
+
+	c.pushLock.Lock()
+	err := c.requests.Push(req)
+	c.pushLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply := <-wait:
+		if reply == nil {
+			return nil, c.failure()
+		}
+		if reply.Error != nil {
+			return nil, reply.Error
+		}
+		if e, ok := reply.Headers[HeaderRpcError]; ok {
+			return nil, &RemoteError{Msg: e}
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops reading replies and closes client connections. Calls in progress fail with
+// ErrRpcClientClosed. Reply queue is not deleted, it is expected to be drained by message TTL.
+func (c *RPCClient) Close() {
+	c.lock.Lock()
+	if c.err == nil {
+		c.err = ErrRpcClientClosed
+		close(c.done)
+	}
+	closed := c.closed
+	c.closed = true
+	c.lock.Unlock()
+	if !closed {
+		// Pending reads and writes fail with I/O errors.
+		c.requests.Close()
+		c.replies.Close()
+	}
+}
+
+func (c *RPCClient) failure() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// readReplies polls reply queue and dispatches replies to waiting calls.
+// Replies to calls which have already timed out are dropped.
+func (c *RPCClient) readReplies() {
+	opts := NewPopOptions().SetWaitTimeout(rpcPollWait).SetLimit(10)
+	for {
+		select {
+		case <-c.done:
+			c.wakeAll()
+			return
+		default:
+		}
+		msgs, err := c.replies.Pop(opts)
+		if err != nil {
+			c.lock.Lock()
+			if c.err == nil {
+				c.err = err
+				close(c.done)
+			}
+			c.lock.Unlock()
+			continue
+		}
+		c.lock.Lock()
+		for _, m := range msgs {
+			if w, ok := c.waiters[m.Headers[HeaderCorrelationId]]; ok {
+				select {
+				case w <- m:
+				default:
+					// Duplicate reply, the first one is already delivered.
+				}
+			}
+		}
+		c.lock.Unlock()
+	}
+}
+
+func (c *RPCClient) wakeAll() {
+	c.lock.Lock()
+	for id, w := range c.waiters {
+		close(w)
+		delete(c.waiters, id)
+	}
+	c.lock.Unlock()
+}
+
+// RPCHandler handles a single request returning reply payload.
+type RPCHandler func(ctx context.Context, req *QueueMessage) (string, error)
+
+// RPCServer consumes requests from a request queue and pushes handler replies
+// into reply queues of the callers.
+type RPCServer struct {
+	fmc         *FireMpqClient
+	requests    *PriorityQueue
+	replies     map[string]*PriorityQueue
+	handler     RPCHandler
+	lockTimeout int64
+}
+
+// NewRPCServer creates a server for requestQueue. lockTimeout is a time in milliseconds
+// a request stays locked while being handled; requests which replies couldn't be pushed
+// because of connection failures become available again after it.
+func NewRPCServer(fmc *FireMpqClient, requestQueue string, lockTimeout int64, handler RPCHandler) (*RPCServer, error) {
+	requests, err := fmc.GetPQueue(requestQueue)
+	if err != nil {
+		return nil, err
+	}
+	return &RPCServer{
+		fmc:         fmc,
+		requests:    requests,
+		replies:     make(map[string]*PriorityQueue),
+		handler:     handler,
+		lockTimeout: lockTimeout,
+	}, nil
+}
+
+// Serve handles requests until ctx is done or request queue fails. It returns nil once ctx is done.
+// Handlers get a context derived from ctx carrying the request trace context.
+// Requests are deleted only after reply is pushed, so they are redelivered after the lock timeout
+// if replying fails because of a connection failure or takes longer than the lock timeout.
+// Requests which reply queue doesn't exist anymore or refuses the reply are dropped, since
+// the caller is gone.
+func (s *RPCServer) Serve(ctx context.Context) error {
+	opts := NewPopLockOptions().SetWaitTimeout(rpcPollWait).SetLockTimeout(s.lockTimeout)
+	for ctx.Err() == nil {
+		msgs, err := s.requests.PopLock(opts)
+		if err != nil {
+			return err
+		}
+		for _, req := range msgs {
+			if err := s.handle(ctx, req); err != nil {
+				// Request stays locked, so retries don't spin reconnecting to the service.
+				continue
+			}
+			if err := s.requests.DeleteByReceipt(req.Receipt); err != nil && !isRejected(err) {
+				// Expired lock only means the request is redelivered.
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *RPCServer) handle(ctx context.Context, req *QueueMessage) error {
+	replyTo := req.Headers[HeaderReplyTo]
+	corrId := req.Headers[HeaderCorrelationId]
+	if replyTo == "" || corrId == "" {
+		// Nobody waits for the reply, so the request can only be dropped.
+		return nil
+	}
+	ctx = s.requests.messageContext(ctx, req)
+	var reply *Message
+	if req.Error != nil {
+		reply = NewMessage("").SetHeader(HeaderRpcError, req.Error.Error())
+	} else if payload, err := s.handler(ctx, req); err != nil {
+		reply = NewMessage("").SetHeader(HeaderRpcError, err.Error())
+	} else {
+		reply = NewMessage(payload)
+	}
+	reply.SetHeader(HeaderCorrelationId, corrId).SetContext(ctx)
+
+	pq, err := s.replyQueue(replyTo)
+	if isRejected(err) {
+		// Reply queue doesn't exist.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := pq.Push(reply); err != nil {
+		if isRejected(err) {
+			return nil
+		}
+		delete(s.replies, replyTo)
+		pq.Close()
+		return err
+	}
+	return nil
+}
+
+func (s *RPCServer) replyQueue(name string) (*PriorityQueue, error) {
+	if pq, ok := s.replies[name]; ok {
+		return pq, nil
+	}
+	pq, err := s.fmc.GetPQueue(name)
+	if err != nil {
+		return nil, err
+	}
+	s.replies[name] = pq
+	return pq, nil
+}
+
+// Close closes request and reply queue connections. It must not be called while Serve is running.
+func (s *RPCServer) Close() {
+	s.requests.Close()
+	for name, pq := range s.replies {
+		pq.Close()
+		delete(s.replies, name)
+	}
+}
+
+func randomId() string {
+	var id [12]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,42 @@
+package pqclient
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	. "github.com/vburenin/firempq_connector/envelope"
+)
+
+type ctxKey struct{}
+
+func TestRPCServerServe(t *testing.T) {
+	payload := Marshal(&Envelope{
+		Headers: map[string]string{HeaderReplyTo: "replies", HeaderCorrelationId: "c1"},
+		Body:    "ping",
+	})
+	requests, _ := testQueue("+MSGS *1 %3 ID a RCPT r1 PL $" + strconv.Itoa(len(payload)) + " " + payload + "\n" +
+		"-ERR 404 $17 Receipt not found\n")
+	replies, out := testQueue("+OK\n")
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "serve"))
+	defer cancel()
+	s := &RPCServer{
+		requests: requests,
+		replies:  map[string]*PriorityQueue{"replies": replies},
+		handler: func(hctx context.Context, req *QueueMessage) (string, error) {
+			if hctx.Value(ctxKey{}) != "serve" {
+				t.Error("Handler context is not derived from Serve context")
+			}
+			cancel()
+			return "pong", nil
+		},
+	}
+	if err := s.Serve(ctx); err != nil {
+		t.Fatalf("Expired request lock stopped the server: %v", err)
+	}
+	reply, err := Unmarshal(pushedPayload(t, out.String()))
+	if err != nil || reply.Body != "pong" || reply.Headers[HeaderCorrelationId] != "c1" {
+		t.Fatalf("Unexpected reply %+v: %v", reply, err)
+	}
+}
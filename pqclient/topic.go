@@ -0,0 +1,221 @@
+package pqclient
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+
+	. "github.com/vburenin/firempq_connector/fmpq_err"
+)
+
+// Topic publishes each message into all its subscriber queues.
+// It is safe for concurrent use.
+type Topic struct {
+	fmc    *FireMpqClient
+	name   string
+	lock   sync.Mutex
+	queues map[string]*topicQueue
+	// others are queues used by PublishTo which are not subscribed.
+	others map[string]*topicQueue
+}
+
+// topicQueue is a lazily connected subscriber queue. Each subscriber has its own
+// connection, so messages are pushed into all of them in parallel.
+type topicQueue struct {
+	lock    sync.Mutex
+	name    string
+	pq      *PriorityQueue
+	removed bool
+}
+
+// disconnect closes queue connection if there is one, the next push reconnects.
+// Must be called with the queue lock held.
+func (q *topicQueue) disconnect() {
+	if q.pq != nil {
+		q.pq.Close()
+		q.pq = nil
+	}
+}
+
+// remove closes the connection of an unsubscribed queue. Publish calls which are already
+// pushing into the queue close the connection they open.
+func (q *topicQueue) remove() {
+	q.lock.Lock()
+	q.removed = true
+	q.disconnect()
+	q.lock.Unlock()
+}
+
+// TopicPublishResult is a result of publishing messages into a single subscriber queue.
+// Error is set if the whole batch failed, otherwise Items contain per message results.
+type TopicPublishResult struct {
+	Queue string
+	Items []PushBatchItem
+	Error error
+}
+
+// Topic returns a topic by its name creating an empty one if it doesn't exist yet.
+func (fmc *FireMpqClient) Topic(name string) *Topic {
+	fmc.topicsLock.Lock()
+	defer fmc.topicsLock.Unlock()
+	if fmc.topics == nil {
+		fmc.topics = make(map[string]*Topic)
+	}
+	t, ok := fmc.topics[name]
+	if !ok {
+		t = &Topic{
+			fmc:    fmc,
+			name:   name,
+			queues: make(map[string]*topicQueue),
+			others: make(map[string]*topicQueue),
+		}
+		fmc.topics[name] = t
+	}
+	return t
+}
+
+// LoadTopics reads topic subscriptions from JSON object mapping
+// topic names to lists of subscriber queues: {"orders": ["billing", "shipping"]}.
+func (fmc *FireMpqClient) LoadTopics(r io.Reader) error {
+	var cfg map[string][]string
+	if err := json.NewDecoder(r).Decode(&cfg); err != nil {
+		return err
+	}
+	for name, queues := range cfg {
+		fmc.Topic(name).Subscribe(queues...)
+	}
+	return nil
+}
+
+func (t *Topic) GetName() string {
+	return t.name
+}
+
+// Subscribe adds subscriber queues to the topic.
+func (t *Topic) Subscribe(queues ...string) *Topic {
+	t.lock.Lock()
+	for _, q := range queues {
+		if _, ok := t.queues[q]; ok {
+			continue
+		}
+		if tq, ok := t.others[q]; ok {
+			// Reuse connection opened by PublishTo.
+			delete(t.others, q)
+			t.queues[q] = tq
+		} else {
+			t.queues[q] = &topicQueue{name: q}
+		}
+	}
+	t.lock.Unlock()
+	return t
+}
+
+// Unsubscribe removes subscriber queues from the topic closing their connections.
+func (t *Topic) Unsubscribe(queues ...string) *Topic {
+	var removed []*topicQueue
+	t.lock.Lock()
+	for _, q := range queues {
+		if tq, ok := t.queues[q]; ok {
+			removed = append(removed, tq)
+			delete(t.queues, q)
+		}
+	}
+	t.lock.Unlock()
+	for _, tq := range removed {
+		tq.remove()
+	}
+	return t
+}
+
+// Close closes connections to all queues the topic has published to. Subscriptions are kept
+// and the next publish opens connections again.
+func (t *Topic) Close() {
+	var queues, others []*topicQueue
+	t.lock.Lock()
+	for _, q := range t.queues {
+		queues = append(queues, q)
+	}
+	for name, q := range t.others {
+		others = append(others, q)
+		delete(t.others, name)
+	}
+	t.lock.Unlock()
+	for _, q := range queues {
+		q.lock.Lock()
+		q.disconnect()
+		q.lock.Unlock()
+	}
+	for _, q := range others {
+		q.remove()
+	}
+}
+
+// Subscribers returns sorted names of subscriber queues.
+func (t *Topic) Subscribers() []string {
+	t.lock.Lock()
+	names := make([]string, 0, len(t.queues))
+	for q := range t.queues {
+		names = append(names, q)
+	}
+	t.lock.Unlock()
+	sort.Strings(names)
+	return names
+}
+
+// Publish pushes messages into all subscriber queues in parallel. Results are sorted by queue name.
+// Failed pushes can be retried for a single queue with PublishTo.
+func (t *Topic) Publish(msgs ...*Message) []TopicPublishResult {
+	t.lock.Lock()
+	queues := make([]*topicQueue, 0, len(t.queues))
+	for _, q := range t.queues {
+		queues = append(queues, q)
+	}
+	t.lock.Unlock()
+	sort.Slice(queues, func(i, j int) bool { return queues[i].name < queues[j].name })
+
+	results := make([]TopicPublishResult, len(queues))
+	var wg sync.WaitGroup
+	for i, q := range queues {
+		wg.Add(1)
+		go func(i int, q *topicQueue) {
+			defer wg.Done()
+			results[i] = t.fmc.pushTo(q, msgs)
+		}(i, q)
+	}
+	wg.Wait()
+	return results
+}
+
+// PublishTo pushes messages into a single queue. Connections to queues which are not
+// subscribed are kept for the next PublishTo call until Close.
+func (t *Topic) PublishTo(queue string, msgs ...*Message) TopicPublishResult {
+	t.lock.Lock()
+	q, ok := t.queues[queue]
+	if !ok {
+		if q, ok = t.others[queue]; !ok {
+			q = &topicQueue{name: queue}
+			t.others[queue] = q
+		}
+	}
+	t.lock.Unlock()
+	return t.fmc.pushTo(q, msgs)
+}
+
+func (fmc *FireMpqClient) pushTo(q *topicQueue, msgs []*Message) TopicPublishResult {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	res := TopicPublishResult{Queue: q.name}
+	if q.pq == nil {
+		if q.pq, res.Error = fmc.GetPQueue(q.name); res.Error != nil {
+			return res
+		}
+	}
+	res.Items, res.Error = q.pq.PushBatch(msgs...)
+	_, ok := res.Error.(*FireMpqError)
+	if (res.Error != nil && !ok) || q.pq.ConnError() != nil || q.removed {
+		// Reconnect next time if connection state is unknown, removed queues keep no connections.
+		q.disconnect()
+	}
+	return res
+}
@@ -0,0 +1,110 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrWaitExceedsDeadline = errors.New("Rate limit wait exceeds context deadline")
+
+// Limiter is a token bucket rate limiter. It is safe for concurrent use, so a single
+// limiter can be shared by multiple queues and goroutines.
+//
+// Requests larger than the bucket size are allowed: they take the bucket into debt,
+// making following requests wait longer.
+type Limiter struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter creates a limiter refilling rate tokens per second up to burst tokens.
+// The bucket starts full.
+func NewLimiter(rate float64, burst int) *Limiter {
+	if rate <= 0 {
+		panic("Rate must be positive")
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill must be called with the lock held.
+func (l *Limiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// Allow takes n tokens if they are available right now.
+func (l *Limiter) Allow(n int) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.refill(time.Now())
+	if l.tokens < float64(n) {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+// Wait takes n tokens waiting until they are available. It returns ctx error if ctx
+// is done before that, or ErrWaitExceedsDeadline right away if the wait is known to
+// be longer than ctx deadline. Tokens are not taken if Wait fails.
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	now := time.Now()
+	l.lock.Lock()
+	l.refill(now)
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	if deadline, ok := ctx.Deadline(); ok && now.Add(delay).After(deadline) {
+		l.tokens += float64(n)
+		l.lock.Unlock()
+		return ErrWaitExceedsDeadline
+	}
+	l.lock.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		l.Return(n)
+		return ctx.Err()
+	}
+}
+
+// Return gives n previously taken and unused tokens back to the bucket.
+func (l *Limiter) Return(n int) {
+	if n <= 0 {
+		return
+	}
+	l.lock.Lock()
+	l.tokens += float64(n)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.lock.Unlock()
+}
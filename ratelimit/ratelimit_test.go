@@ -0,0 +1,104 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// elapse moves limiter clock d forward.
+func elapse(l *Limiter, d time.Duration) {
+	l.lock.Lock()
+	l.last = l.last.Add(-d)
+	l.lock.Unlock()
+}
+
+func TestLimiterBurst(t *testing.T) {
+	l := NewLimiter(1, 3)
+	for i := 0; i < 3; i++ {
+		if !l.Allow(1) {
+			t.Fatalf("Request %d is not allowed within burst", i)
+		}
+	}
+	if l.Allow(1) {
+		t.Fatal("Request is allowed over burst")
+	}
+}
+
+func TestLimiterRefill(t *testing.T) {
+	l := NewLimiter(10, 5)
+	if !l.Allow(5) {
+		t.Fatal("Full bucket is not allowed")
+	}
+	elapse(l, 200*time.Millisecond)
+	if !l.Allow(2) || l.Allow(1) {
+		t.Fatal("Bucket isn't refilled at rate")
+	}
+	elapse(l, time.Hour)
+	if !l.Allow(5) || l.Allow(1) {
+		t.Fatal("Bucket is refilled over burst")
+	}
+}
+
+func TestLimiterReturn(t *testing.T) {
+	l := NewLimiter(1, 2)
+	l.Allow(2)
+	l.Return(1)
+	if !l.Allow(1) || l.Allow(1) {
+		t.Fatal("Returned token isn't available")
+	}
+	l.Return(10)
+	if !l.Allow(2) || l.Allow(1) {
+		t.Fatal("Returned tokens overflow burst")
+	}
+}
+
+func TestLimiterWait(t *testing.T) {
+	l := NewLimiter(100, 1)
+	start := time.Now()
+	if err := l.Wait(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Wait(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 15*time.Millisecond {
+		t.Fatalf("Waited %v for 2 tokens at 100/s", d)
+	}
+	// Request larger than burst leaves the bucket in debt.
+	if l.Allow(1) {
+		t.Fatal("Token is available right after waiting")
+	}
+}
+
+func TestLimiterWaitExceedsDeadline(t *testing.T) {
+	l := NewLimiter(1, 1)
+	l.Allow(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := l.Wait(ctx, 1); err != ErrWaitExceedsDeadline {
+		t.Fatalf("Got %v, want ErrWaitExceedsDeadline", err)
+	}
+	if time.Since(start) > 50*time.Millisecond {
+		t.Fatal("Wait didn't fail right away")
+	}
+	elapse(l, time.Second)
+	if !l.Allow(1) {
+		t.Fatal("Tokens are taken by failed wait")
+	}
+}
+
+func TestLimiterWaitCancel(t *testing.T) {
+	l := NewLimiter(1, 1)
+	l.Allow(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := l.Wait(ctx, 1); err != context.Canceled {
+		t.Fatalf("Got %v, want context.Canceled", err)
+	}
+	elapse(l, time.Second)
+	if !l.Allow(1) {
+		t.Fatal("Tokens of canceled wait aren't returned")
+	}
+}
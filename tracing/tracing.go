@@ -0,0 +1,45 @@
+package tracing
+
+import "context"
+
+// Span is a single traced client operation.
+type Span interface {
+	// SetAttribute attaches a key/value pair to the span.
+	SetAttribute(key, value string)
+	// SetError marks span as failed.
+	SetError(err error)
+	// End completes the span.
+	End()
+}
+
+// Tracer is an abstraction over a tracing library. It creates client spans around
+// queue commands and propagates trace context through message headers.
+// OpenTelemetry or any other library can be plugged in by implementing this interface,
+// so the client itself doesn't depend on any of them.
+type Tracer interface {
+	// Start starts a new span as a child of the span in ctx.
+	Start(ctx context.Context, name string) (context.Context, Span)
+	// Inject writes trace context found in ctx into message headers.
+	Inject(ctx context.Context, headers map[string]string)
+	// Extract reads trace context from message headers and returns ctx carrying it.
+	Extract(ctx context.Context, headers map[string]string) context.Context
+}
+
+// NopTracer doesn't trace or propagate anything.
+type NopTracer struct{}
+
+func (NopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+func (NopTracer) Inject(ctx context.Context, headers map[string]string) {}
+
+func (NopTracer) Extract(ctx context.Context, headers map[string]string) context.Context {
+	return ctx
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(key, value string) {}
+func (nopSpan) SetError(err error)             {}
+func (nopSpan) End()                           {}
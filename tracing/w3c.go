@@ -0,0 +1,114 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+)
+
+// W3C Trace Context header names.
+const (
+	TraceParentHeader = "traceparent"
+	TraceStateHeader  = "tracestate"
+)
+
+var ErrInvalidTraceParent = errors.New("Invalid traceparent value")
+
+// SpanContext is a W3C Trace Context span identity.
+type SpanContext struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	Flags      byte
+	TraceState string
+}
+
+// IsValid returns true if both trace and span ids are set.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceParent formats span context as a traceparent header value.
+func (sc SpanContext) TraceParent() string {
+	b := make([]byte, 0, 55)
+	b = append(b, "00-"...)
+	b = hex.AppendEncode(b, sc.TraceID[:])
+	b = append(b, '-')
+	b = hex.AppendEncode(b, sc.SpanID[:])
+	b = append(b, '-')
+	b = hex.AppendEncode(b, []byte{sc.Flags})
+	return string(b)
+}
+
+// ParseTraceParent parses a traceparent header value of version 00.
+func ParseTraceParent(v string) (SpanContext, error) {
+	var sc SpanContext
+	if len(v) < 55 || v[2] != '-' || v[35] != '-' || v[52] != '-' || v[:2] == "ff" {
+		return sc, ErrInvalidTraceParent
+	}
+	if len(v) > 55 && (v[:2] == "00" || v[55] != '-') {
+		return sc, ErrInvalidTraceParent
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(sc.TraceID[:], []byte(v[3:35])); err != nil {
+		return sc, ErrInvalidTraceParent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(v[36:52])); err != nil {
+		return sc, ErrInvalidTraceParent
+	}
+	if _, err := hex.Decode(flags[:], []byte(v[53:55])); err != nil {
+		return sc, ErrInvalidTraceParent
+	}
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return sc, ErrInvalidTraceParent
+	}
+	return sc, nil
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpanContext returns a copy of ctx carrying span context.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns span context stored in ctx if any.
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok
+}
+
+// W3CTracer is a dependency free Tracer which only propagates W3C trace context.
+// Spans it creates get new span ids, but aren't recorded anywhere.
+type W3CTracer struct{}
+
+func (W3CTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	sc, ok := SpanContextFromContext(ctx)
+	if !ok {
+		rand.Read(sc.TraceID[:])
+		sc.Flags = 1
+	}
+	rand.Read(sc.SpanID[:])
+	return ContextWithSpanContext(ctx, sc), nopSpan{}
+}
+
+func (W3CTracer) Inject(ctx context.Context, headers map[string]string) {
+	sc, ok := SpanContextFromContext(ctx)
+	if !ok || !sc.IsValid() {
+		return
+	}
+	headers[TraceParentHeader] = sc.TraceParent()
+	if sc.TraceState != "" {
+		headers[TraceStateHeader] = sc.TraceState
+	}
+}
+
+func (W3CTracer) Extract(ctx context.Context, headers map[string]string) context.Context {
+	sc, err := ParseTraceParent(headers[TraceParentHeader])
+	if err != nil {
+		return ctx
+	}
+	sc.TraceState = headers[TraceStateHeader]
+	return ContextWithSpanContext(ctx, sc)
+}
@@ -0,0 +1,108 @@
+package tracing
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+const testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestParseTraceParent(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		valid bool
+	}{
+		{"valid", testTraceParent, true},
+		{"not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true},
+		{"future version", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"future version with extra fields", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true},
+		{"empty", "", false},
+		{"invalid version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"version 00 with extra fields", testTraceParent + "-extra", false},
+		{"extra data without separator", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01x", false},
+		{"too short", testTraceParent[:54], false},
+		{"short trace id", "00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false},
+		{"long span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7a-01", false},
+		{"wrong separator", "00_4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7_01", false},
+		{"non hex trace id", "00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01", false},
+		{"non hex span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902bx-01", false},
+		{"non hex flags", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0x", false},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"zero span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, err := ParseTraceParent(tt.value)
+			if !tt.valid {
+				if err != ErrInvalidTraceParent {
+					t.Fatalf("Got %+v, %v, want ErrInvalidTraceParent", sc, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sc.TraceParent(); got != "00"+tt.value[2:55] {
+				t.Fatalf("Got %q, want %q", got, tt.value[:55])
+			}
+		})
+	}
+}
+
+func TestW3CTracerPropagation(t *testing.T) {
+	var tracer W3CTracer
+	sc, _ := ParseTraceParent(testTraceParent)
+	sc.TraceState = "vendor=value"
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		headers map[string]string
+	}{
+		{"no span context", context.Background(), map[string]string{}},
+		{"invalid span context", ContextWithSpanContext(context.Background(), SpanContext{}), map[string]string{}},
+		{"span context", ContextWithSpanContext(context.Background(), sc), map[string]string{
+			TraceParentHeader: testTraceParent,
+			TraceStateHeader:  "vendor=value",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{}
+			tracer.Inject(tt.ctx, headers)
+			if len(headers) != len(tt.headers) || headers[TraceParentHeader] != tt.headers[TraceParentHeader] ||
+				headers[TraceStateHeader] != tt.headers[TraceStateHeader] {
+				t.Fatalf("Got headers %v, want %v", headers, tt.headers)
+			}
+			extracted, ok := SpanContextFromContext(tracer.Extract(context.Background(), headers))
+			if ok != (len(tt.headers) > 0) || ok && extracted != sc {
+				t.Fatalf("Extracted %+v, %v", extracted, ok)
+			}
+		})
+	}
+}
+
+func TestW3CTracerExtractIgnoresInvalidHeaders(t *testing.T) {
+	for _, v := range []string{"", "garbage", strings.Replace(testTraceParent, "00f067aa0ba902b7", "0000000000000000", 1)} {
+		ctx := W3CTracer{}.Extract(context.Background(), map[string]string{TraceParentHeader: v})
+		if sc, ok := SpanContextFromContext(ctx); ok {
+			t.Errorf("Extracted %+v from %q", sc, v)
+		}
+	}
+}
+
+func TestW3CTracerStart(t *testing.T) {
+	var tracer W3CTracer
+	ctx, _ := tracer.Start(context.Background(), "root")
+	root, ok := SpanContextFromContext(ctx)
+	if !ok || !root.IsValid() || root.Flags != 1 {
+		t.Fatalf("Got root span context %+v", root)
+	}
+	ctx, _ = tracer.Start(ctx, "child")
+	child, _ := SpanContextFromContext(ctx)
+	if child.TraceID != root.TraceID || child.SpanID == root.SpanID {
+		t.Fatalf("Child span context %+v doesn't continue %+v", child, root)
+	}
+}